@@ -0,0 +1,205 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+//=================================================================================
+// Weave backends - the output formats of weave
+//=================================================================================
+
+// Backend writes a woven document in one output format. The Weaver works out
+// what to write (which chunks and lines are visible, how code is indented, how
+// blocks are numbered and where references and inline code are) and calls the
+// methods of its backend in document order:
+//
+//	BeginDocument
+//	  BeginText (BeginLine (Text | CodeRef | InlineCode)* EndLine)* EndText
+//	  BeginCode (BeginLine (Text | CodeRef)* EndLine)* EndCode [BlockAnnotations]
+//	  ...
+//	  [BeginIndex IndexEntry* EndIndex]
+//	EndDocument
+//
+// Text, CodeRef and InlineCode receive their text with the `#` escapes already
+// replaced. BlockAnnotations and the index are only sent if the WeaveIndex
+// option is true.
+type Backend interface {
+	BeginDocument(w io.Writer, doc *WeaveDocument) error
+	EndDocument(w io.Writer, doc *WeaveDocument) error
+
+	BeginText(w io.Writer, chunk *TextChunk) error
+	EndText(w io.Writer, chunk *TextChunk) error
+
+	BeginCode(w io.Writer, code *WeaveCode) error
+	EndCode(w io.Writer, code *WeaveCode) error
+
+	// BeginLine starts a line of the current chunk that was read from pos.
+	BeginLine(w io.Writer, pos FilePos) error
+	EndLine(w io.Writer) error
+
+	Text(w io.Writer, s string) error
+	CodeRef(w io.Writer, ref *WeaveRef) error
+	InlineCode(w io.Writer, code string) error
+
+	// BlockAnnotations follows a code chunk that declares or uses Go names.
+	BlockAnnotations(w io.Writer, ann *WeaveAnnotations) error
+
+	// BeginIndex starts the index of the Go names declared in the visible
+	// chunks, which has an IndexEntry for each name in order.
+	BeginIndex(w io.Writer) error
+	IndexEntry(w io.Writer, entry *WeaveIndexEntry) error
+	EndIndex(w io.Writer) error
+}
+
+// WeaveDocument describes the document being woven to a Backend.
+type WeaveDocument struct {
+	Doc *Document
+
+	// Preamble holds the visible lines that come before the first chunk.
+	Preamble []SourceLine
+
+	// GoIndex says which chunks are Go code and which chunks declare and use
+	// the names declared in the Go code.
+	GoIndex *GoIndex
+
+	blocks map[string]*WeaveBlockInfo
+	byId   []*WeaveBlockInfo
+
+	// order gives the number of each chunk in Doc.Chunks.
+	order map[Chunk]int
+}
+
+// Block returns the information about the block with the given canonical
+// name, or nil if it is not mentioned in the visible chunks.
+func (d *WeaveDocument) Block(canonical string) *WeaveBlockInfo {
+	return d.blocks[canonical]
+}
+
+// BlockById returns the information about the block with the given id, or nil
+// if there is no such block.
+func (d *WeaveDocument) BlockById(id int) *WeaveBlockInfo {
+	if id < 1 || id > len(d.byId) {
+		return nil
+	}
+	return d.byId[id-1]
+}
+
+// Blocks returns the information about every block mentioned in the visible
+// chunks, in order of their ids.
+func (d *WeaveDocument) Blocks() []*WeaveBlockInfo {
+	return d.byId
+}
+
+// WeaveCode describes a visible code chunk to a Backend.
+type WeaveCode struct {
+	Chunk *CodeChunk
+
+	// Block describes the block the chunk is part of, and Id is its id.
+	// Series counts the visible chunks of the block that come before this
+	// one.
+	Block  *WeaveBlockInfo
+	Id     int
+	Series int
+}
+
+// WeaveRef describes a << .. >> reference to a Backend.
+type WeaveRef struct {
+	Name      string
+	Canonical string
+
+	// Block describes the referenced block, and Id is its id. InCode is
+	// true if the reference is in a code chunk.
+	Block  *WeaveBlockInfo
+	Id     int
+	InCode bool
+
+	// Prev and Next are the series of the last visible chunk of the block
+	// before the reference and of the first one after it, or -1 if there
+	// is none.
+	Prev int
+	Next int
+}
+
+// WeaveAnnotations describes to a Backend the Go names that a code chunk
+// declares, and the names declared in other chunks that it uses, both sorted.
+type WeaveAnnotations struct {
+	Code    *WeaveCode
+	Defines []string
+	Uses    []WeaveUse
+}
+
+// WeaveUse is a Go name used by a code chunk. Decl refers to the block that
+// declares it, or is nil if that block is not woven or the name is declared
+// more than once.
+type WeaveUse struct {
+	Name string
+	Decl *WeaveRef
+}
+
+// WeaveIndexEntry describes a Go name in the index to a Backend, with
+// references to the blocks that declare it and to the other blocks that use
+// it. Each block is referred to once.
+type WeaveIndexEntry struct {
+	Name      string
+	DefinedIn []*WeaveRef
+	UsedIn    []*WeaveRef
+}
+
+// Format is an output format that weave can produce.
+type Format struct {
+	Name string
+
+	// Ext is the usual extension of files in this format.
+	Ext string
+
+	// NewBackend creates a backend that writes the format.
+	NewBackend func(ctx *RunContext) Backend
+
+	// Config holds the configuration options that differ from the defaults
+	// for this format, such as its WeaveCommand.
+	Config map[string]string
+
+	// ConfigFile is the configuration file that the glitter command reads
+	// when none is given, or "" if there is none.
+	ConfigFile string
+}
+
+// formats lists the built in formats. The first is the default.
+var formats = []Format{
+	{Name: "latex", Ext: ".tex", NewBackend: newLatexBackend, ConfigFile: "glittertex.cls"},
+	{Name: "html", Ext: ".html", NewBackend: newHTMLBackend,
+		Config: map[string]string{"WeaveCommand": "", "IndexTitle": "Index"}},
+	{Name: "typst", Ext: ".typ", NewBackend: newTypstBackend,
+		Config: map[string]string{"WeaveCommand": `typst compile "${weavefile}"`, "IndexTitle": "= Index"}},
+	{Name: "markdown", Ext: ".md", NewBackend: newMarkdownBackend,
+		Config: map[string]string{"WeaveCommand": "", "IndexTitle": "## Index"}},
+	{Name: "pandoc", Ext: ".json", NewBackend: newPandocBackend,
+		Config: map[string]string{"WeaveCommand": "", "IndexTitle": "Index"}},
+}
+
+// FormatNames returns the names of the formats that weave can produce.
+func FormatNames() []string {
+	out := make([]string, 0, len(formats))
+	for _, f := range formats {
+		out = append(out, f.Name)
+	}
+	return out
+}
+
+// LookupFormat returns the format with the given name. The empty name is the
+// default format.
+func LookupFormat(name string) (Format, error) {
+	if name == "" {
+		return formats[0], nil
+	}
+	for _, f := range formats {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return Format{}, fmt.Errorf("unknown weave format `%s` (known formats: %s)",
+		name, strings.Join(FormatNames(), ", "))
+}
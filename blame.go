@@ -0,0 +1,62 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+//=================================================================================
+// Blame - where the lines of a tangled file came from
+//=================================================================================
+
+// Blame returns the lines of filename, a file in the run's Outputs written by
+// tangle, with the places in the glitter sources they came from. These are
+// read from the file's source map, which tangle writes if SourceMaps is set;
+// a file can be made from blocks in any of the glitter files of a run, so
+// there is no other record of them. It is an error if the file has changed
+// since tangle wrote it.
+func Blame(filename string, ctx *RunContext) ([]TangledLine, error) {
+	fsys, ok := ctx.Outputs.(fs.FS)
+	if !ok {
+		return nil, errors.New("cannot read files from the outputs")
+	}
+	data, err := fs.ReadFile(fsys, filename)
+	if err != nil {
+		return nil, err
+	}
+	entry, listed, err := manifestEntryFor(ctx, filename)
+	switch {
+	case err != nil:
+		return nil, err
+	case !listed:
+		return nil, fmt.Errorf("`%s` is not listed in %s, so was not written by tangle", filename, MANIFEST_FILE)
+	case entry.Sum != checksum(data):
+		return nil, fmt.Errorf("`%s` has changed since it was tangled", filename)
+	}
+
+	mapData, err := fs.ReadFile(fsys, filename+SOURCE_MAP_EXT)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("`%s` has no source map; tangle it again with source maps", filename)
+	} else if err != nil {
+		return nil, err
+	}
+	lines, err := readSourceMap(mapData)
+	if err != nil {
+		return nil, err
+	}
+	text := make([]string, 0)
+	if len(data) > 0 {
+		text = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	}
+	if len(lines) != len(text) {
+		return nil, fmt.Errorf("the source map of `%s` is for a file with %d lines, not %d; tangle it again",
+			filename, len(lines), len(text))
+	}
+	for i := range lines {
+		lines[i].Text = text[i]
+	}
+	return lines, nil
+}
@@ -0,0 +1,87 @@
+package glitter
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestBlame(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Logger.SetOutput(io.Discard)
+	ctx.Sources = fstest.MapFS{"prog.gw": {Data: []byte(tangleTestSource)}}
+	ctx.SourceMaps = true
+	out := NewMemFS()
+	ctx.Outputs = out
+	if err := Tangle([]string{"prog.gw"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	lines, err := Blame("out.go", ctx)
+	if err != nil {
+		t.Fatalf("Blame() error = %v", err)
+	}
+	if len(lines) != 5 || !strings.HasSuffix(lines[3].Text, "return") {
+		t.Fatalf("Blame() = %+v", lines)
+	}
+	// the line directive before "return" is part of the segment of the
+	// reference in line 10, but the line is about line 13.
+	s, off, ok := lines[3].MainOrigin()
+	if !ok || s.Block != "body of f" || s.Pos.LineNo() != 13 || lines[3].Text[off:] != "return" ||
+		len(s.Chain()) != 2 || s.Chain()[0].Pos.LineNo() != 6 {
+		t.Errorf("MainOrigin() = %+v, %d", s, off)
+	}
+
+	w, _ := out.Create("out.go")
+	io.WriteString(w, "package main // edited\n")
+	w.Close()
+	if _, err := Blame("out.go", ctx); err == nil || !strings.Contains(err.Error(), "has changed since it was tangled") {
+		t.Errorf("Blame() of an edited file: error = %v", err)
+	}
+}
+
+func TestBlameSeveralSources(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Logger.SetOutput(io.Discard)
+	ctx.Sources = fstest.MapFS{
+		"a.gw": {Data: []byte("<<* \"out.go\">>=\npackage main\n<<Helpers>>\n")},
+		"b.gw": {Data: []byte("<<Helpers>>=\nfunc h() {}\n")},
+	}
+	ctx.Config["TangleLineRef"] = ""
+	ctx.SourceMaps = true
+	ctx.Outputs = NewMemFS()
+	if err := Tangle([]string{"a.gw", "b.gw"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := Blame("out.go", ctx)
+	if err != nil {
+		t.Fatalf("Blame() error = %v", err)
+	}
+	if len(lines) != 2 || lines[1].Text != "func h() {}" {
+		t.Fatalf("Blame() = %+v", lines)
+	}
+	if s, _, ok := lines[1].MainOrigin(); !ok || s.Pos.Filename() != "b.gw" || s.Pos.LineNo() != 2 {
+		t.Errorf("MainOrigin() = %+v", s)
+	}
+
+	ctx.SourceMaps = false
+	if err := Tangle([]string{"a.gw", "b.gw"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Blame("out.go", ctx); err == nil || !strings.Contains(err.Error(), "has no source map") {
+		t.Errorf("Blame() without a source map: error = %v", err)
+	}
+}
+
+func TestBlameNotTangled(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	out := NewMemFS()
+	ctx.Outputs = out
+	w, _ := out.Create("other.go")
+	io.WriteString(w, "package other\n")
+	w.Close()
+	if _, err := Blame("other.go", ctx); err == nil || !strings.Contains(err.Error(), "not listed in") {
+		t.Errorf("Blame() of a file tangle did not write: error = %v", err)
+	}
+}
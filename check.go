@@ -0,0 +1,260 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+//=================================================================================
+// Checking - find problems in a set of glitter sources
+//=================================================================================
+
+// The kinds of problem that Check finds.
+const (
+	ProblemUndefined    = "undefined"
+	ProblemUnreferenced = "unreferenced"
+	ProblemCycle        = "cycle"
+	ProblemTopLevelRef  = "top-level-ref"
+	ProblemEmpty        = "empty"
+	ProblemDuplicateTop = "duplicate-top-level"
+	ProblemUseBeforeDef = "use-before-definition"
+)
+
+// Problem is something in the sources that is probably a mistake, although
+// they can still be parsed.
+type Problem struct {
+	Pos  FilePos
+	Kind string
+	Msg  string
+
+	// at is the number of the chunk the problem is in, which orders the
+	// problems.
+	at int
+}
+
+// String returns the problem as file:line: message.
+func (p *Problem) String() string {
+	return fmt.Sprintf("%s:%d: %s", p.Pos.Filename(), p.Pos.LineNo(), p.Msg)
+}
+
+// Check reads the given files and returns the problems in them.
+func Check(filenames []string, ctx *RunContext) ([]*Problem, error) {
+	doc, err := Parse(NewGlitterScanner(filenames, ctx))
+	if err != nil {
+		return nil, err
+	}
+	return doc.Check(), nil
+}
+
+// checker holds what Check knows about the blocks of a document.
+type checker struct {
+	doc      *Document
+	problems []*Problem
+
+	// defs holds the chunks that define each block, and first the number of
+	// the first of them in doc.Chunks.
+	defs  map[string][]*CodeChunk
+	first map[string]int
+
+	// names holds the sorted canonical names of the defined blocks that are
+	// not top-level.
+	names []string
+}
+
+// report adds a problem found in chunk number at.
+func (c *checker) report(at int, pos FilePos, kind, msg string, args ...any) {
+	c.problems = append(c.problems, &Problem{Pos: pos, Kind: kind, Msg: fmt.Sprintf(msg, args...), at: at})
+}
+
+// Check returns the problems in the document, in the order they appear in
+// its chunks:
+//
+//   - references to blocks that are never defined, with the defined names
+//     that are close to the name used,
+//   - blocks, other than top-level ones, that are never referenced from code,
+//   - cycles of references,
+//   - references to top-level blocks,
+//   - chunks with no code,
+//   - chunks for the same top-level file and order in different files, and
+//   - references that come before any definition of their block.
+//
+// Hidden chunks are checked as well, since they are still tangled.
+func (d *Document) Check() []*Problem {
+	c := &checker{
+		doc:      d,
+		problems: make([]*Problem, 0),
+		defs:     make(map[string][]*CodeChunk),
+		first:    make(map[string]int),
+		names:    make([]string, 0),
+	}
+	for i, ch := range d.Chunks {
+		if code, ok := ch.(*CodeChunk); ok {
+			if _, ok := c.defs[code.Canonical]; !ok {
+				c.first[code.Canonical] = i
+				if !code.TopLevel {
+					c.names = append(c.names, code.Canonical)
+				}
+			}
+			c.defs[code.Canonical] = append(c.defs[code.Canonical], code)
+		}
+	}
+	slices.Sort(c.names)
+
+	c.checkRefs()
+	c.checkChunks()
+	c.checkCycles()
+	slices.SortStableFunc(c.problems, func(a, b *Problem) int {
+		return cmp.Compare(a.at, b.at)
+	})
+	return c.problems
+}
+
+// chunkRefs returns the references in a chunk.
+func chunkRefs(ch Chunk) []*Ref {
+	switch ch := ch.(type) {
+	case *TextChunk:
+		return ch.Refs
+	case *CodeChunk:
+		return ch.Refs
+	}
+	return nil
+}
+
+// checkRefs reports references to undefined and top-level blocks, and
+// references that come before the block is defined.
+func (c *checker) checkRefs() {
+	for i, ch := range c.doc.Chunks {
+		for _, r := range chunkRefs(ch) {
+			switch {
+			case isTopLevelName(r.Canonical):
+				c.report(i, r.Pos, ProblemTopLevelRef, "reference to top-level block `%s`", r.Name)
+			case len(c.defs[r.Canonical]) == 0:
+				msg := fmt.Sprintf("undefined block `%s`", r.Canonical)
+				if near := c.closeNames(r.Canonical); len(near) > 0 {
+					msg += fmt.Sprintf(" (did you mean `%s`?)", strings.Join(near, "`, `"))
+				}
+				c.report(i, r.Pos, ProblemUndefined, "%s", msg)
+			case c.first[r.Canonical] > i:
+				first := c.defs[r.Canonical][0].pos
+				c.report(i, r.Pos, ProblemUseBeforeDef, "block `%s` is used before it is defined at %s:%d",
+					r.Canonical, first.Filename(), first.LineNo())
+			}
+		}
+	}
+}
+
+// checkChunks reports empty chunks, blocks that are never referenced from
+// code, and top-level blocks defined in more than one file.
+func (c *checker) checkChunks() {
+	used := make(map[string]Void)
+	for _, code := range c.doc.CodeChunks() {
+		for _, r := range code.Refs {
+			used[r.Canonical] = Void{}
+		}
+	}
+	for i, ch := range c.doc.Chunks {
+		code, ok := ch.(*CodeChunk)
+		if !ok {
+			continue
+		}
+		if !slices.ContainsFunc(code.Lines, func(l ChunkLine) bool { return strings.TrimSpace(l.line) != "" }) {
+			c.report(i, code.pos, ProblemEmpty, "block `%s` has no code", code.Name)
+		}
+		first := c.defs[code.Canonical][0]
+		if code.TopLevel && code.pos.filename != first.pos.filename {
+			c.report(i, code.pos, ProblemDuplicateTop, "top-level block for %q order %d is also defined in %s:%d",
+				code.File, code.Order, first.pos.Filename(), first.pos.LineNo())
+		}
+		if _, ok := used[code.Canonical]; !ok && !code.TopLevel && code == first {
+			c.report(i, code.pos, ProblemUnreferenced, "block `%s` is never used", code.Canonical)
+		}
+	}
+}
+
+// checkCycles reports each cycle of references between blocks once, at the
+// reference that closes it, in the form that tangle reports it. The search
+// starts from each reference in code, so that every block in a cycle is
+// reached through a reference with a position.
+func (c *checker) checkCycles() {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	path := make([]Expansion, 0)
+
+	var visit func(ref *Ref)
+	visit = func(ref *Ref) {
+		state[ref.Canonical] = visiting
+		path = append(path, Expansion{Block: ref.Canonical, Pos: ref.Pos})
+		for _, code := range c.defs[ref.Canonical] {
+			for _, r := range code.Refs {
+				switch state[r.Canonical] {
+				case unvisited:
+					visit(r)
+				case visiting:
+					c.report(c.first[ref.Canonical], r.Pos, ProblemCycle, "reference cycle: %s",
+						cycleSteps(path, r.Canonical, r.Pos))
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[ref.Canonical] = done
+	}
+	for _, code := range c.doc.CodeChunks() {
+		for _, r := range code.Refs {
+			if state[r.Canonical] == unvisited {
+				visit(r)
+			}
+		}
+	}
+}
+
+// closeNames returns the names of defined blocks that are a few edits away
+// from name, closest first.
+func (c *checker) closeNames(name string) []string {
+	limit := max(1, len([]rune(name))/3)
+	type near struct {
+		name string
+		dist int
+	}
+	found := make([]near, 0)
+	for _, n := range c.names {
+		if d := editDistance(name, n); d <= limit {
+			found = append(found, near{n, d})
+		}
+	}
+	slices.SortStableFunc(found, func(a, b near) int { return cmp.Compare(a.dist, b.dist) })
+	out := make([]string, 0, len(found))
+	for _, f := range found {
+		out = append(out, f.name)
+	}
+	return out
+}
+
+// editDistance returns the number of rune insertions, deletions and
+// substitutions that turn a into b.
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := range ra {
+		cur[0] = i + 1
+		for j := range rb {
+			cost := 1
+			if ra[i] == rb[j] {
+				cost = 0
+			}
+			cur[j+1] = min(prev[j+1]+1, cur[j]+1, prev[j]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
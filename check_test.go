@@ -0,0 +1,109 @@
+package glitter
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestDocumentCheck(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Sources = fstest.MapFS{
+		"main.gw": {Data: []byte(`@: The parts.
+<<* "prog.go">>=
+    <<Helpers>>
+    <<Helpres>>
+    <<Loop>>
+    <<* "prog.go">>
+<<Helpers>>=
+    func h() {}
+<<Unused>>=
+    func u() {}
+<<Loop>>=
+    <<Loop body>>
+<<Loop body>>=
+    <<Loop>>
+<<Empty>>=
+
+@include "other.gw"
+`)},
+		"other.gw": {Data: []byte(`<<* "prog.go">>=
+    <<Empty>>
+`)},
+	}
+	doc, err := Parse(NewGlitterScanner([]string{"main.gw"}, ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, 0)
+	for _, p := range doc.Check() {
+		got = append(got, p.Kind+" "+p.String())
+	}
+	want := []string{
+		"use-before-definition main.gw:3: block `helpers` is used before it is defined at main.gw:7",
+		"undefined main.gw:4: undefined block `helpres` (did you mean `helpers`?)",
+		"use-before-definition main.gw:5: block `loop` is used before it is defined at main.gw:11",
+		"top-level-ref main.gw:6: reference to top-level block `* \"prog.go\"`",
+		"unreferenced main.gw:9: block `unused` is never used",
+		"use-before-definition main.gw:12: block `loop body` is used before it is defined at main.gw:13",
+		"cycle main.gw:14: reference cycle: `loop` (main.gw:5) → `loop body` (main.gw:12) → `loop` (main.gw:14)",
+		"empty main.gw:15: block `Empty` has no code",
+		"duplicate-top-level other.gw:1: top-level block for \"prog.go\" order 0 is also defined in main.gw:2",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got problems:\n%q\nwant:\n%q", got, want)
+	}
+}
+
+func TestCheckCycleMatchesTangle(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	src := `<<* "out.go">>=
+    <<A>> <<B>>
+<<A>>=
+    <<B>>
+<<B>>=
+    <<C>>
+<<C>>=
+    x := 1
+    <<A>>
+`
+	doc, err := Parse(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	_, terr := tg.TangleFile("out.go")
+	if terr == nil {
+		t.Fatal("TangleFile() did not find the cycle")
+	}
+	cycles := make([]string, 0)
+	for _, p := range doc.Check() {
+		if p.Kind == ProblemCycle {
+			cycles = append(cycles, p.String())
+		}
+	}
+	if !slices.Equal(cycles, []string{terr.Error()}) {
+		t.Errorf("Check() cycles = %q, want %q", cycles, terr)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"helpers", "helpres", 2},
+		{"loop", "loop body", 5},
+		{"héllo", "hello", 1},
+	} {
+		if got := editDistance(tc.a, tc.b); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
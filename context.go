@@ -0,0 +1,286 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//=================================================================================
+// Run contexts
+//=================================================================================
+
+// Mode says what kind of output a run produces.
+type Mode int8
+
+// These are the kinds of runs.
+const (
+	ModeWeave Mode = iota
+	ModeTangle
+)
+
+// String returns the name of the command that corresponds to the mode.
+func (m Mode) String() string {
+	switch m {
+	case ModeWeave:
+		return "weave"
+	case ModeTangle:
+		return "tangle"
+	}
+	return "mode(" + strconv.Itoa(int(m)) + ")"
+}
+
+// RunContext holds everything about a single weave or tangle run: the
+// configuration, how much to log and where to log it, and what kind of output
+// is being produced. Nothing in the package reads global state, so runs with
+// different contexts can proceed concurrently.
+type RunContext struct {
+	GlitterOptions
+	Mode   Mode
+	Logger *log.Logger
+
+	// Sources is the filesystem that glitter files (and their includes) are
+	// read from.
+	Sources fs.FS
+
+	// Outputs is the filesystem that tangled files are written to.
+	Outputs WriteFS
+
+	// Format names the output format of a weave run. The empty string is
+	// the default format, LaTeX.
+	Format string
+
+	// WeaveFile is the name of the woven output file. It is substituted for
+	// ${weavefile} in commands.
+	WeaveFile string
+
+	// positions holds the lines of each file written by tangle, by its
+	// cleaned name, with the places in the sources they came from.
+	positions map[string][]TangledLine
+}
+
+// NewRunContext creates a context for a run in the given mode. The
+// configuration in opts is copied, so later changes to opts do not affect the
+// run. Messages are logged to os.Stderr, and files are read from and written
+// to the operating system's filesystem.
+func NewRunContext(mode Mode, opts GlitterOptions) *RunContext {
+	opts.Config = maps.Clone(opts.Config)
+	if opts.Config == nil {
+		opts.Config = make(map[string]string)
+	}
+	return &RunContext{
+		GlitterOptions: opts,
+		Mode:           mode,
+		Logger:         log.New(os.Stderr, "glitter: ", 0),
+		Sources:        OSFS{},
+		Outputs:        OSFS{},
+	}
+}
+
+// SetFormat sets the output format of the run, and sets the configuration
+// options that the format changes from the defaults.
+func (c *RunContext) SetFormat(name string) error {
+	format, err := LookupFormat(name)
+	if err != nil {
+		return err
+	}
+	c.Format = format.Name
+	maps.Copy(c.Config, format.Config)
+	return nil
+}
+
+// Info prints the message if the verbosity level is level or greater.
+func (c *RunContext) Info(level int, msg string, args ...any) {
+	if c.Verbose >= level {
+		c.Logger.Printf(msg+"\n", args...)
+	}
+}
+
+// InfoWithFile prints the message, preceeded by the file and line number, if
+// the verbosity level is level or greater.
+func (c *RunContext) InfoWithFile(level int, pos *FilePos, msg string, args ...any) {
+	if c.Verbose >= level {
+		c.Logger.Printf(fmt.Sprintf("%s:%d: %s\n", pos.Filename(), pos.LineNo(), msg), args...)
+	}
+}
+
+// lineCommand returns the appropriate string to mark a line number pragma.
+func (c *RunContext) lineCommand(pos FilePos) string {
+	var tt string
+	switch c.Mode {
+	case ModeWeave:
+		tt = c.GetConfig("WeaveLineRef")
+	case ModeTangle:
+		tt = c.GetConfig("TangleLineRef")
+	}
+	return expandVars(tt, map[string]string{
+		"lineno":   strconv.Itoa(pos.LineNo()),
+		"filename": pos.Filename(),
+	})
+}
+
+// ExecuteCommand executes the given command, after doing some substitutions.
+// An empty command does nothing. The output of the command is written to the
+// Logger as it runs in a tangle run or when verbose, and otherwise only if
+// the command fails.
+func (c *RunContext) ExecuteCommand(cmd string) error {
+	if strings.TrimSpace(cmd) == "" {
+		return nil
+	}
+	explicitShell := false
+	var err error
+	cmd = os.Expand(cmd, func(s string) string {
+		switch s {
+		case "weavefile":
+			return c.WeaveFile
+		case "SHELL":
+			explicitShell = true
+			return c.GetConfig("Shell")
+		default:
+			err = fmt.Errorf("unknown replacement in command: `%s`", s)
+			return ""
+		}
+	})
+	if err != nil {
+		return err
+	}
+	c.Info(1, "Running `%s`...", cmd)
+
+	// if $SHELL was given as in the command string, run it directly.
+	var command *exec.Cmd
+	if explicitShell {
+		args := strings.Fields(cmd)
+		command = exec.Command(args[0], args[1:]...)
+	} else {
+		// otherwise, use the Shell config option and give it the -c option.
+		command = exec.Command(c.GetConfig("Shell"), "-c", cmd)
+	}
+	// the output of the TangleCommand, or of any command when verbose, is
+	// shown as it comes. Otherwise, such as for the WeaveCommand's long
+	// pdflatex output, it is kept and only shown if the command fails. Either
+	// way, positions in tangled files are replaced by their places in the
+	// glitter sources.
+	var kept bytes.Buffer
+	w := io.Writer(&kept)
+	if c.Mode == ModeTangle || c.Verbose >= 1 {
+		w = c.Logger.Writer()
+	}
+	out := &positionWriter{ctx: c, w: w}
+	command.Stdout = out
+	command.Stderr = out
+	err = command.Run()
+	out.Flush()
+	if err != nil {
+		c.Logger.Writer().Write(kept.Bytes())
+		return fmt.Errorf("`%s` failed: %w", cmd, err)
+	}
+	return nil
+}
+
+// positionWriter writes the output of a command to w a line at a time, with
+// the positions in it mapped by mapPositions.
+type positionWriter struct {
+	ctx     *RunContext
+	w       io.Writer
+	partial []byte
+}
+
+// Write writes the complete lines of p, and holds back any text after the
+// last newline until the rest of its line arrives.
+func (pw *positionWriter) Write(p []byte) (int, error) {
+	pw.partial = append(pw.partial, p...)
+	if i := bytes.LastIndexByte(pw.partial, '\n'); i >= 0 {
+		if _, err := pw.w.Write(pw.ctx.mapPositions(pw.partial[:i+1])); err != nil {
+			return 0, err
+		}
+		pw.partial = slices.Clone(pw.partial[i+1:])
+	}
+	return len(p), nil
+}
+
+// Flush writes the last line of the output, if it does not end in a newline.
+func (pw *positionWriter) Flush() error {
+	if len(pw.partial) == 0 {
+		return nil
+	}
+	_, err := pw.w.Write(pw.ctx.mapPositions(pw.partial))
+	pw.partial = nil
+	return err
+}
+
+// positionRegex matches a file:line or file:line:column position in a Go
+// file, as given by the compiler.
+var positionRegex = regexp.MustCompile(`([^\s:"'()]+\.go):(\d+)(?::(\d+))?`)
+
+// mapPositions returns the output of a command with each position in a file
+// written by tangle replaced by the place in the glitter sources that the
+// text there came from. The block and the original position are added to the
+// end of the line.
+func (c *RunContext) mapPositions(out []byte) []byte {
+	if len(c.positions) == 0 {
+		return out
+	}
+	lines := strings.SplitAfter(string(out), "\n")
+	for i, line := range lines {
+		note := ""
+		lines[i] = positionRegex.ReplaceAllStringFunc(line, func(pos string) string {
+			m := positionRegex.FindStringSubmatch(pos)
+			seg, col, ok := c.lookupPosition(m[1], m[2], m[3])
+			if !ok {
+				return pos
+			}
+			if note == "" {
+				note = fmt.Sprintf(" (in block `%s`, %s)", seg.Block, pos)
+			}
+			if m[3] == "" {
+				return fmt.Sprintf("%s:%d", seg.Pos.Filename(), seg.Pos.LineNo())
+			}
+			return fmt.Sprintf("%s:%d:%d", seg.Pos.Filename(), seg.Pos.LineNo(), col)
+		})
+		if note != "" {
+			body, nl := strings.CutSuffix(lines[i], "\n")
+			lines[i] = body + note
+			if nl {
+				lines[i] += "\n"
+			}
+		}
+	}
+	return []byte(strings.Join(lines, ""))
+}
+
+// lookupPosition returns the segment that the given file, line and column,
+// as text, fall in, and the column in the glitter source. An empty column is
+// the start of the line.
+func (c *RunContext) lookupPosition(file, line, col string) (Segment, int, bool) {
+	file = filepath.Clean(file)
+	if filepath.IsAbs(file) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, file); err == nil {
+				file = rel
+			}
+		}
+	}
+	lines, ok := c.positions[filepath.ToSlash(file)]
+	n, _ := strconv.Atoi(line)
+	if !ok || n < 1 || n > len(lines) {
+		return Segment{}, 0, false
+	}
+	off := 0
+	if col != "" {
+		off, _ = strconv.Atoi(col)
+		off--
+	}
+	seg, ok := lines[n-1].Origin(off)
+	return seg, seg.SourceCol(off) + 1, ok
+}
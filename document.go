@@ -0,0 +1,436 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+//=================================================================================
+// Documents - the parsed form of a set of glitter sources
+//=================================================================================
+
+// Document is the parsed form of everything read by a GlitterScanner. Weave
+// and tangle (and anything else that needs to know what the sources say) work
+// from a Document rather than from the source lines.
+type Document struct {
+	// Preamble holds the lines that come before the first block.
+	Preamble []ChunkLine
+
+	// Chunks holds the text and code chunks in the order they were read.
+	Chunks []Chunk
+
+	// Includes and Directives hold the @include and @glitter lines in the
+	// order they were read.
+	Includes   []*IncludeDirective
+	Directives []*GlitterDirective
+
+	// Abbreviations maps each abbreviated name used in the document (the
+	// canonical form of a name that ends in "..." or "…") to the canonical
+	// name of the block it stands for.
+	Abbreviations map[string]string
+}
+
+// Chunk is either a *TextChunk or a *CodeChunk.
+type Chunk interface {
+	// Pos returns the position of the line that starts the chunk.
+	Pos() FilePos
+	isChunk()
+}
+
+// ChunkLine is a line of a chunk. Hidden lines are between `@glitter hide`
+// and `@glitter show`; they are not woven but are still tangled.
+type ChunkLine struct {
+	SourceLine
+	Hidden bool
+}
+
+// Ref is a << .. >> reference to a code block that appears in a chunk.
+type Ref struct {
+	// Name is the name as written and Canonical is its canonical form, with
+	// abbreviations resolved.
+	Name      string
+	Canonical string
+
+	// Pos is the position of the line containing the reference, Line is the
+	// index of that line in its chunk, and Start and End are the byte
+	// offsets of the << and just after the >> in that line.
+	Pos        FilePos
+	Line       int
+	Start, End int
+}
+
+// TextChunk is a block of natural language started by `@:`.
+type TextChunk struct {
+	pos FilePos
+
+	// Key is true if the chunk was started by more than one `:`, which marks
+	// the next code block as a key block.
+	Key    bool
+	Hidden bool
+
+	// Chapter is the file the chunk belongs to: the file given to the
+	// scanner, or the file it includes, that the chunk was read from,
+	// directly or through further includes.
+	Chapter string
+
+	// Lines holds the lines of the chunk. The first line is the text that
+	// follows the `@:` marker.
+	Lines []ChunkLine
+	Refs  []*Ref
+}
+
+// CodeChunk is a code block started by `<<name>>=`.
+type CodeChunk struct {
+	pos FilePos
+
+	// Name is the name as written. Canonical is the name that identifies the
+	// block: the canonical name (with abbreviations resolved), or
+	// `* "file" order` for a top-level block.
+	Name      string
+	Canonical string
+
+	// Key is true if the chunk follows a text chunk that marks it as a key
+	// block.
+	Key    bool
+	Hidden bool
+
+	// TopLevel is true if the block is written to File, in the place given
+	// by Order.
+	TopLevel bool
+	File     string
+	Order    int
+
+	// Series counts the chunks with the same Canonical name that come before
+	// this one.
+	Series int
+
+	// Chapter is the file the chunk belongs to, as for a TextChunk.
+	Chapter string
+
+	Lines []ChunkLine
+	Refs  []*Ref
+}
+
+// IncludeDirective is an `@include "file"` line.
+type IncludeDirective struct {
+	pos      FilePos
+	Filename string
+	Hidden   bool
+}
+
+// GlitterDirective is an `@glitter prop...` line.
+type GlitterDirective struct {
+	pos   FilePos
+	Props []string
+}
+
+// Pos returns the position of the chunk's start line.
+func (c *TextChunk) Pos() FilePos { return c.pos }
+
+// Pos returns the position of the chunk's start line.
+func (c *CodeChunk) Pos() FilePos { return c.pos }
+
+// Pos returns the position of the @include line.
+func (d *IncludeDirective) Pos() FilePos { return d.pos }
+
+// Pos returns the position of the @glitter line.
+func (d *GlitterDirective) Pos() FilePos { return d.pos }
+
+// Has returns true if the directive lists the given property.
+func (d *GlitterDirective) Has(property string) bool {
+	for _, p := range d.Props {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+func (*TextChunk) isChunk() {}
+func (*CodeChunk) isChunk() {}
+
+// CodeChunks returns the code chunks of the document in reading order.
+func (d *Document) CodeChunks() []*CodeChunk {
+	out := make([]*CodeChunk, 0)
+	for _, c := range d.Chunks {
+		if cc, ok := c.(*CodeChunk); ok {
+			out = append(out, cc)
+		}
+	}
+	return out
+}
+
+// findRefs returns the code references in line, which is line number i of a
+// chunk.
+func findRefs(line string, pos FilePos, i int) []*Ref {
+	out := make([]*Ref, 0)
+	for _, m := range codeRefRegex.FindAllStringSubmatchIndex(line, -1) {
+		name := line[m[2]:m[3]]
+		out = append(out, &Ref{
+			Name:      name,
+			Canonical: canonicalCodeName(name),
+			Pos:       pos,
+			Line:      i,
+			Start:     m[0],
+			End:       m[1],
+		})
+	}
+	return out
+}
+
+// outputScope holds the output file state of one level of includes.
+type outputScope struct {
+	defaultFile string
+	currentFile string
+	top         bool
+}
+
+// Parse reads every line from the scanner and returns the parsed document.
+func Parse(scanner *GlitterScanner) (*Document, error) {
+	ctx := scanner.ctx
+	doc := &Document{
+		Preamble:   make([]ChunkLine, 0),
+		Chunks:     make([]Chunk, 0),
+		Includes:   make([]*IncludeDirective, 0),
+		Directives: make([]*GlitterDirective, 0),
+	}
+
+	var text *TextChunk
+	var code *CodeChunk
+	isHiding := false
+	pendingKey := false
+	series := make(map[string]int)
+
+	// The output file of top-level blocks depends on the file being read:
+	// each file given to the scanner starts a new scope, and so does every
+	// include of a file with a `@glitter top` line. The current file is
+	// sticky within a scope and the files it includes.
+	scopes := make([]outputScope, 0)
+	topFile := -1
+	chapter := ""
+
+	for l, err := range scanner.Lines() {
+		if err != nil {
+			return nil, err
+		}
+		// keep the output scopes in step with the include depth.
+		if l.depth == 1 && l.file != topFile {
+			topFile = l.file
+			def := createOutputFilename(l.pos.filename)
+			scopes = append(scopes[:0], outputScope{defaultFile: def, currentFile: def})
+		}
+		for len(scopes) > l.depth {
+			popped := scopes[len(scopes)-1]
+			scopes = scopes[:len(scopes)-1]
+			if !popped.top {
+				scopes[len(scopes)-1].currentFile = popped.currentFile
+			}
+		}
+		for len(scopes) < l.depth {
+			parent := scopes[len(scopes)-1]
+			parent.top = false
+			scopes = append(scopes, parent)
+		}
+		scope := &scopes[len(scopes)-1]
+		if l.depth <= 2 {
+			chapter = l.pos.filename
+		}
+
+		if filename, ok := l.Include(); ok {
+			doc.Includes = append(doc.Includes, &IncludeDirective{
+				pos:      l.pos,
+				Filename: filename,
+				Hidden:   isHiding,
+			})
+			continue
+		}
+
+		t, arg := computeLineType(l.line)
+		switch t {
+
+		case TextStartLine:
+			code = nil
+			text = &TextChunk{
+				pos:     l.pos,
+				Key:     len(arg) > 1,
+				Hidden:  isHiding,
+				Chapter: chapter,
+				Lines:   make([]ChunkLine, 0),
+				Refs:    make([]*Ref, 0),
+			}
+			if text.Key && !isHiding {
+				pendingKey = true
+			}
+			first := *l
+			first.line = removeTextStart(l.line)
+			text.Refs = append(text.Refs, findRefs(first.line, first.pos, 0)...)
+			text.Lines = append(text.Lines, ChunkLine{SourceLine: first, Hidden: isHiding})
+			doc.Chunks = append(doc.Chunks, text)
+
+		case CodeStartLine:
+			text = nil
+			code = &CodeChunk{
+				pos:       l.pos,
+				Name:      strings.TrimSpace(arg),
+				Canonical: canonicalCodeName(arg),
+				Hidden:    isHiding,
+				Chapter:   chapter,
+				Lines:     make([]ChunkLine, 0),
+				Refs:      make([]*Ref, 0),
+			}
+			if !isHiding {
+				code.Key = pendingKey
+				pendingKey = false
+			}
+			// if this looks like a top-level reference, parse it
+			if isTopLevelName(code.Canonical) {
+				filename, order, ok := parseTopLevelName(code.Canonical, scope.currentFile)
+				if !ok {
+					return nil, ErrorWithFile(l.pos, "badly formated top-level name `%s`", code.Canonical)
+				}
+				// if the filename is empty or a single ., then switch back to
+				// the main output file.
+				if len(filename) == 0 || filename == "." {
+					filename = scope.defaultFile
+				}
+				scope.currentFile = filename
+				code.TopLevel = true
+				code.File = filename
+				code.Order = order
+				code.Canonical = fmt.Sprintf("* \"%s\" %d", filename, order)
+			}
+			code.Series = series[code.Canonical]
+			series[code.Canonical]++
+			ctx.InfoWithFile(2, &l.pos, "At code block `%s`", code.Canonical)
+			doc.Chunks = append(doc.Chunks, code)
+
+		case GlitterLine:
+			d := &GlitterDirective{pos: l.pos, Props: strings.Fields(arg)}
+			doc.Directives = append(doc.Directives, d)
+			if d.Has("hide") {
+				isHiding = true
+			}
+			if d.Has("show") {
+				isHiding = false
+			}
+			if d.Has("top") {
+				scope.defaultFile = createOutputFilename(l.pos.filename)
+				scope.currentFile = scope.defaultFile
+				scope.top = l.depth > 1
+			}
+
+		case OtherLine:
+			line := ChunkLine{SourceLine: *l, Hidden: isHiding}
+			switch {
+			case code != nil:
+				code.Refs = append(code.Refs, findRefs(l.line, l.pos, len(code.Lines))...)
+				code.Lines = append(code.Lines, line)
+			case text != nil:
+				text.Refs = append(text.Refs, findRefs(l.line, l.pos, len(text.Lines))...)
+				text.Lines = append(text.Lines, line)
+			default:
+				doc.Preamble = append(doc.Preamble, line)
+			}
+		}
+	}
+	if err := doc.resolveAbbreviations(); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// abbreviationPrefix returns the prefix that a canonical name abbreviates,
+// and true, if the name ends in "..." or "…". Top-level names are never
+// abbreviations.
+func abbreviationPrefix(canonical string) (string, bool) {
+	if isTopLevelName(canonical) {
+		return "", false
+	}
+	for _, suffix := range []string{"...", "…"} {
+		if p, ok := strings.CutSuffix(canonical, suffix); ok {
+			return strings.TrimSpace(p), true
+		}
+	}
+	return "", false
+}
+
+// Resolve returns the canonical name of the block that the canonical name
+// stands for: the full name if it is an abbreviation, and the name itself
+// otherwise.
+func (d *Document) Resolve(canonical string) string {
+	if full, ok := d.Abbreviations[canonical]; ok {
+		return full
+	}
+	return canonical
+}
+
+// resolveAbbreviations replaces the abbreviated names of code chunks and
+// references with the unique name, among the names of the code chunks that
+// are not abbreviated, that they are a prefix of. It is an error if there is
+// no such name or more than one. Since this may join chunks to blocks, the
+// series of the chunks are counted again.
+func (d *Document) resolveAbbreviations() error {
+	d.Abbreviations = make(map[string]string)
+	names := make([]string, 0)
+	for _, c := range d.CodeChunks() {
+		if _, ok := abbreviationPrefix(c.Canonical); !ok && !c.TopLevel {
+			names = append(names, c.Canonical)
+		}
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	resolve := func(canonical string, pos FilePos) (string, error) {
+		prefix, ok := abbreviationPrefix(canonical)
+		if !ok {
+			return canonical, nil
+		}
+		if full, ok := d.Abbreviations[canonical]; ok {
+			return full, nil
+		}
+		matches := make([]string, 0)
+		for _, n := range names {
+			if strings.HasPrefix(n, prefix) {
+				matches = append(matches, "`"+n+"`")
+			}
+		}
+		switch len(matches) {
+		case 0:
+			return "", ErrorWithFile(pos, "abbreviation `%s` does not match any block", canonical)
+		case 1:
+			full := strings.Trim(matches[0], "`")
+			d.Abbreviations[canonical] = full
+			return full, nil
+		}
+		return "", ErrorWithFile(pos, "abbreviation `%s` matches more than one block: %s",
+			canonical, strings.Join(matches, ", "))
+	}
+
+	var err error
+	for _, c := range d.Chunks {
+		refs := make([]*Ref, 0)
+		switch c := c.(type) {
+		case *TextChunk:
+			refs = c.Refs
+		case *CodeChunk:
+			if c.Canonical, err = resolve(c.Canonical, c.pos); err != nil {
+				return err
+			}
+			refs = c.Refs
+		}
+		for _, r := range refs {
+			if r.Canonical, err = resolve(r.Canonical, r.Pos); err != nil {
+				return err
+			}
+		}
+	}
+
+	series := make(map[string]int)
+	for _, c := range d.CodeChunks() {
+		c.Series = series[c.Canonical]
+		series[c.Canonical]++
+	}
+	return nil
+}
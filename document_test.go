@@ -0,0 +1,136 @@
+package glitter
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestParse(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Sources = fstest.MapFS{
+		"main.gw": {Data: []byte(`\title{x}
+@:: Intro <<Helpers>>.
+<<* "prog.go">>=
+    <<Helpers>>
+@glitter hide
+@include "lib.gw"
+@glitter show
+<<*>>=
+    main()
+`)},
+		"lib.gw": {Data: []byte(`@glitter top
+<<*>>=
+    lib()
+<<Helpers>>=
+    func h() {}
+`)},
+	}
+	doc, err := Parse(NewGlitterScanner([]string{"main.gw"}, ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(doc.Preamble) != 1 || doc.Preamble[0].Line() != `\title{x}` {
+		t.Errorf("Preamble = %v", doc.Preamble)
+	}
+	if len(doc.Includes) != 1 || doc.Includes[0].Filename != "lib.gw" || !doc.Includes[0].Hidden {
+		t.Errorf("Includes = %+v", doc.Includes)
+	}
+	if len(doc.Directives) != 3 {
+		t.Errorf("got %d directives, want 3", len(doc.Directives))
+	}
+
+	text, ok := doc.Chunks[0].(*TextChunk)
+	if !ok || !text.Key || len(text.Refs) != 1 || text.Refs[0].Canonical != "helpers" {
+		t.Fatalf("first chunk = %+v", doc.Chunks[0])
+	}
+
+	want := []struct {
+		canonical string
+		key       bool
+		hidden    bool
+		series    int
+	}{
+		{`* "prog.go" 0`, true, false, 0},
+		{`* "lib.go" 0`, false, true, 0},
+		{"helpers", false, true, 0},
+		// the @glitter top in lib.gw only applies to lib.gw, and the
+		// current file is sticky.
+		{`* "prog.go" 0`, false, false, 1},
+	}
+	code := doc.CodeChunks()
+	if len(code) != len(want) {
+		t.Fatalf("got %d code chunks, want %d", len(code), len(want))
+	}
+	for i, w := range want {
+		c := code[i]
+		if c.Canonical != w.canonical || c.Key != w.key || c.Hidden != w.hidden || c.Series != w.series {
+			t.Errorf("chunk %d = {%q key=%v hidden=%v series=%d}, want %+v",
+				i, c.Canonical, c.Key, c.Hidden, c.Series, w)
+		}
+	}
+
+	r := code[0].Refs[0]
+	if r.Pos.Filename() != "main.gw" || r.Pos.LineNo() != 4 || r.Line != 0 || r.Start != 4 || r.End != 15 {
+		t.Errorf("ref = %+v", r)
+	}
+}
+
+func TestParseAbbreviations(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	src := `@: See <<Read the...>>.
+<<* "prog.go">>=
+    <<Read the input…>>
+    <<Write ...>>
+<<Read the input file and check it>>=
+    read()
+<<Read the ...>>=
+    check()
+<<Write the output>>=
+    write()
+`
+	doc, err := Parse(NewGlitterScannerFromReader("a.gw", strings.NewReader(src), ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := doc.CodeChunks()
+	if code[2].Canonical != "read the input file and check it" || code[2].Series != 1 {
+		t.Errorf("abbreviated chunk = {%q series=%d}", code[2].Canonical, code[2].Series)
+	}
+	if r := code[0].Refs[1]; r.Name != "Write ..." || r.Canonical != "write the output" {
+		t.Errorf("abbreviated ref = %+v", r)
+	}
+	if r := doc.Chunks[0].(*TextChunk).Refs[0]; r.Canonical != "read the input file and check it" {
+		t.Errorf("abbreviated text ref = %+v", r)
+	}
+	if got := doc.Resolve("read the input…"); got != "read the input file and check it" {
+		t.Errorf("Resolve() = %q", got)
+	}
+
+	tg := NewTangler(ctx)
+	ctx.Config["TangleLineRef"] = ""
+	tg.AddDocument(doc)
+	var out strings.Builder
+	if err := tg.WriteFile("prog.go", &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "read()\ncheck()\nwrite()\n"; out.String() != want {
+		t.Errorf("WriteFile() = %q, want %q", out.String(), want)
+	}
+}
+
+func TestParseBadAbbreviations(t *testing.T) {
+	tests := []struct{ src, want string }{
+		{"<<Read a>>=\n<<Read b>>=\n<<X>>=\n  <<read...>>\n",
+			"a.gw:4: abbreviation `read...` matches more than one block: `read a`, `read b`"},
+		{"<<Read a>>=\n<<Write...>>=\n", "a.gw:2: abbreviation `write...` does not match any block"},
+	}
+	for _, tt := range tests {
+		ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+		_, err := Parse(NewGlitterScannerFromReader("a.gw", strings.NewReader(tt.src), ctx))
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("Parse(%q) error = %v, want %s", tt.src, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"cmp"
+	"encoding/json"
+	"io"
+	"slices"
+)
+
+//=================================================================================
+// Dump - the parsed form of a set of glitter sources, as JSON
+//=================================================================================
+
+// dumpDocument is the JSON form of a Document.
+type dumpDocument struct {
+	Blocks   []*dumpBlock   `json:"blocks"`
+	Outputs  []*dumpOutput  `json:"outputs"`
+	Chunks   []*dumpChunk   `json:"chunks"`
+	Includes []*dumpInclude `json:"includes"`
+	Preamble []dumpLine     `json:"preamble"`
+}
+
+// dumpBlock is a code block: every chunk with the same canonical name, and
+// every reference to that name.
+type dumpBlock struct {
+	Canonical      string     `json:"canonical"`
+	Name           string     `json:"name"`
+	TopLevel       bool       `json:"topLevel"`
+	File           string     `json:"file,omitempty"`
+	Order          int        `json:"order"`
+	Key            bool       `json:"key"`
+	Definitions    []*dumpDef `json:"definitions"`
+	ReferencedFrom []dumpUse  `json:"referencedFrom"`
+}
+
+// dumpDef is a chunk that defines part of a block. Chunk is the index of the
+// chunk in the document's chunks.
+type dumpDef struct {
+	Pos    FilePos    `json:"pos"`
+	Chunk  int        `json:"chunk"`
+	Series int        `json:"series"`
+	Key    bool       `json:"key"`
+	Hidden bool       `json:"hidden"`
+	Refs   []*dumpRef `json:"refs"`
+}
+
+// dumpUse is a reference to a block from a code chunk.
+type dumpUse struct {
+	Block string  `json:"block"`
+	Pos   FilePos `json:"pos"`
+}
+
+// dumpRef is a << .. >> reference.
+type dumpRef struct {
+	Name      string  `json:"name"`
+	Canonical string  `json:"canonical"`
+	Pos       FilePos `json:"pos"`
+	Line      int     `json:"line"`
+	Start     int     `json:"start"`
+	End       int     `json:"end"`
+}
+
+// dumpOutput is a file written by tangle, with the top-level blocks written
+// to it in order.
+type dumpOutput struct {
+	File   string   `json:"file"`
+	Blocks []string `json:"blocks"`
+}
+
+// dumpChunk is a text or code chunk.
+type dumpChunk struct {
+	Kind      string     `json:"kind"`
+	Pos       FilePos    `json:"pos"`
+	Chapter   string     `json:"chapter"`
+	Name      string     `json:"name,omitempty"`
+	Canonical string     `json:"canonical,omitempty"`
+	Key       bool       `json:"key"`
+	Hidden    bool       `json:"hidden"`
+	Lines     []dumpLine `json:"lines"`
+	Refs      []*dumpRef `json:"refs"`
+}
+
+// dumpLine is a line of a chunk or of the preamble.
+type dumpLine struct {
+	Pos    FilePos `json:"pos"`
+	Text   string  `json:"text"`
+	Hidden bool    `json:"hidden"`
+}
+
+// dumpInclude is an @include line.
+type dumpInclude struct {
+	Pos    FilePos `json:"pos"`
+	File   string  `json:"file"`
+	Hidden bool    `json:"hidden"`
+}
+
+// dumpRefs returns the JSON form of refs.
+func dumpRefs(refs []*Ref) []*dumpRef {
+	out := make([]*dumpRef, 0, len(refs))
+	for _, r := range refs {
+		out = append(out, &dumpRef{
+			Name:      r.Name,
+			Canonical: r.Canonical,
+			Pos:       r.Pos,
+			Line:      r.Line,
+			Start:     r.Start,
+			End:       r.End,
+		})
+	}
+	return out
+}
+
+// dumpLines returns the JSON form of lines.
+func dumpLines(lines []ChunkLine) []dumpLine {
+	out := make([]dumpLine, 0, len(lines))
+	for _, l := range lines {
+		out = append(out, dumpLine{Pos: l.pos, Text: l.line, Hidden: l.Hidden})
+	}
+	return out
+}
+
+// WriteJSON writes the document to out as indented JSON. The blocks are
+// listed in the order they are first mentioned, by a definition or a
+// reference, and the outputs in the order tangle writes them.
+func (d *Document) WriteJSON(out io.Writer) error {
+	dd := &dumpDocument{
+		Blocks:   make([]*dumpBlock, 0),
+		Outputs:  make([]*dumpOutput, 0),
+		Chunks:   make([]*dumpChunk, 0, len(d.Chunks)),
+		Includes: make([]*dumpInclude, 0, len(d.Includes)),
+		Preamble: dumpLines(d.Preamble),
+	}
+	blocks := make(map[string]*dumpBlock)
+	block := func(canonical, name string) *dumpBlock {
+		b, ok := blocks[canonical]
+		if !ok {
+			b = &dumpBlock{
+				Canonical:      canonical,
+				Name:           name,
+				Definitions:    make([]*dumpDef, 0),
+				ReferencedFrom: make([]dumpUse, 0),
+			}
+			blocks[canonical] = b
+			dd.Blocks = append(dd.Blocks, b)
+		}
+		return b
+	}
+
+	for i, c := range d.Chunks {
+		switch c := c.(type) {
+		case *TextChunk:
+			dd.Chunks = append(dd.Chunks, &dumpChunk{
+				Kind:    "text",
+				Pos:     c.pos,
+				Chapter: c.Chapter,
+				Key:     c.Key,
+				Hidden:  c.Hidden,
+				Lines:   dumpLines(c.Lines),
+				Refs:    dumpRefs(c.Refs),
+			})
+			for _, r := range c.Refs {
+				block(r.Canonical, r.Name)
+			}
+		case *CodeChunk:
+			dd.Chunks = append(dd.Chunks, &dumpChunk{
+				Kind:      "code",
+				Pos:       c.pos,
+				Chapter:   c.Chapter,
+				Name:      c.Name,
+				Canonical: c.Canonical,
+				Key:       c.Key,
+				Hidden:    c.Hidden,
+				Lines:     dumpLines(c.Lines),
+				Refs:      dumpRefs(c.Refs),
+			})
+			b := block(c.Canonical, c.Name)
+			if len(b.Definitions) == 0 {
+				b.Name = c.Name
+			}
+			b.TopLevel, b.File, b.Order = c.TopLevel, c.File, c.Order
+			b.Key = b.Key || c.Key
+			b.Definitions = append(b.Definitions, &dumpDef{
+				Pos:    c.pos,
+				Chunk:  i,
+				Series: c.Series,
+				Key:    c.Key,
+				Hidden: c.Hidden,
+				Refs:   dumpRefs(c.Refs),
+			})
+			for _, r := range c.Refs {
+				used := block(r.Canonical, r.Name)
+				used.ReferencedFrom = append(used.ReferencedFrom, dumpUse{Block: c.Canonical, Pos: r.Pos})
+			}
+		}
+	}
+
+	top := make([]*dumpBlock, 0)
+	for _, b := range dd.Blocks {
+		if b.TopLevel {
+			top = append(top, b)
+		}
+	}
+	slices.SortStableFunc(top, func(a, b *dumpBlock) int {
+		if n := cmp.Compare(a.File, b.File); n != 0 {
+			return n
+		}
+		return cmp.Compare(a.Order, b.Order)
+	})
+	for _, b := range top {
+		if n := len(dd.Outputs); n == 0 || dd.Outputs[n-1].File != b.File {
+			dd.Outputs = append(dd.Outputs, &dumpOutput{File: b.File, Blocks: make([]string, 0)})
+		}
+		o := dd.Outputs[len(dd.Outputs)-1]
+		o.Blocks = append(o.Blocks, b.Canonical)
+	}
+
+	for _, inc := range d.Includes {
+		dd.Includes = append(dd.Includes, &dumpInclude{Pos: inc.pos, File: inc.Filename, Hidden: inc.Hidden})
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dd)
+}
@@ -0,0 +1,70 @@
+package glitter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDocumentWriteJSON(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	doc, err := Parse(NewGlitterScannerFromReader("prog.gw", strings.NewReader(tangleTestSource+"<<Unused>>=\n    <<Missing>>\n"), ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := doc.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	type pos struct {
+		File string
+		Line int
+	}
+	var got struct {
+		Blocks []struct {
+			Canonical   string
+			TopLevel    bool
+			File        string
+			Definitions []struct {
+				Pos  pos
+				Refs []struct{ Canonical string }
+			}
+			ReferencedFrom []struct {
+				Block string
+				Pos   pos
+			}
+		}
+		Outputs []struct {
+			File   string
+			Blocks []string
+		}
+		Chunks []struct{ Kind string }
+	}
+	if err := json.Unmarshal([]byte(out.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Blocks) != 5 {
+		t.Fatalf("got %d blocks, want 5:\n%s", len(got.Blocks), out.String())
+	}
+	top := got.Blocks[0]
+	if top.Canonical != `* "out.go" 0` || !top.TopLevel || top.File != "out.go" ||
+		top.Definitions[0].Pos != (pos{"prog.gw", 3}) || top.Definitions[0].Refs[0].Canonical != "functions" {
+		t.Errorf("blocks[0] = %+v", top)
+	}
+	fns := got.Blocks[1]
+	if fns.Canonical != "functions" || len(fns.ReferencedFrom) != 1 ||
+		fns.ReferencedFrom[0].Block != `* "out.go" 0` || fns.ReferencedFrom[0].Pos != (pos{"prog.gw", 6}) {
+		t.Errorf("blocks[1] = %+v", fns)
+	}
+	if missing := got.Blocks[4]; missing.Canonical != "missing" || len(missing.Definitions) != 0 {
+		t.Errorf("blocks[4] = %+v", missing)
+	}
+	if len(got.Outputs) != 1 || got.Outputs[0].File != "out.go" || got.Outputs[0].Blocks[0] != `* "out.go" 0` {
+		t.Errorf("outputs = %+v", got.Outputs)
+	}
+	if len(got.Chunks) != 6 || got.Chunks[0].Kind != "text" || got.Chunks[1].Kind != "code" {
+		t.Errorf("chunks = %+v", got.Chunks)
+	}
+}
@@ -0,0 +1,104 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bufio"
+	"io/fs"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+//=================================================================================
+// File search (for tangle)
+//=================================================================================
+
+// lineHasGlitterProp returns true if this is a glitter line and it
+// contains the property.
+func lineHasGlitterProp(line, property string) bool {
+	subs := glitterRegex.FindStringSubmatch(line)
+	// not @gitter line or a gitter line with no props
+	if len(subs) <= 1 {
+		return false
+	}
+
+	for _, p := range strings.Fields(subs[1]) {
+		if p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGlitterProp returns true if the first non-empty line in the given file is
+// a @glitter line that contains the word given by property. If there is any
+// error reading the file, we return false.
+func hasGlitterProp(fsys fs.FS, filename, property string) bool {
+	f, err := fsys.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+		return lineHasGlitterProp(line, property)
+	}
+	return false
+}
+
+// findTopFiles searches for top-level files. If filename exists but is not a
+// directory, then it is a top-level file and the only file returned. If it is
+// a directory, then we walk the tree rooted at that directory looking for
+// files that end with GLITTER_EXT and that contain a `@glitter top` line as
+// their first non-empty line.
+func findTopFiles(fsys fs.FS, filename string) ([]string, error) {
+	filename = path.Clean(filename)
+
+	stat, err := fs.Stat(fsys, filename)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0)
+	if stat.IsDir() {
+		err := fs.WalkDir(fsys, filename,
+			func(p string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				if !d.IsDir() && path.Ext(d.Name()) == GLITTER_EXT {
+					if hasGlitterProp(fsys, p, "top") {
+						out = append(out, p)
+					}
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		out = append(out, filename)
+	}
+	return out, nil
+}
+
+// FindTangleFiles creates a list of files in fsys to tangle. Non-directories are
+// added to the list directly. Directories are searched using findTopFiles. The
+// list of files is de-duped and sorted.
+func FindTangleFiles(fsys fs.FS, filenames []string) ([]string, error) {
+	out := make([]string, 0)
+	for _, f := range filenames {
+		list, err := findTopFiles(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, list...)
+	}
+	sort.Strings(out)
+	return slices.Compact(out), nil
+}
@@ -0,0 +1,146 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"errors"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//=================================================================================
+// Formatting - run gofmt on tangled Go files
+//=================================================================================
+
+// lineDirectiveRegex matches the start of a //line or /*line comment.
+var lineDirectiveRegex = regexp.MustCompile(`([/][/*])line `)
+
+// formatGo returns src, the tangled Go file filename made of lines, formatted
+// as gofmt would, and the lines of the formatted file. If src does not parse,
+// the syntax errors are returned at the places in the glitter sources they
+// come from.
+func formatGo(filename string, src []byte, lines []TangledLine) ([]byte, []TangledLine, error) {
+	out, err := format.Source(src)
+	if err == nil {
+		return out, realignLines(lines, out), nil
+	}
+
+	// Parse again with the line comments turned into plain ones, so that the
+	// errors are at their places in the tangled file. The replacement has the
+	// same length, so the columns do not move.
+	plain := lineDirectiveRegex.ReplaceAll(src, []byte("${1}LINE "))
+	_, perr := parser.ParseFile(token.NewFileSet(), filename, plain, parser.ParseComments)
+	var list scanner.ErrorList
+	if !errors.As(perr, &list) {
+		return nil, nil, err
+	}
+	errs := make([]error, 0, len(list))
+	for _, e := range list {
+		errs = append(errs, syntaxError(filename, e, lines))
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// syntaxError returns the error e, found in the tangled file filename, at the
+// place in the glitter sources that the text it is about came from.
+func syntaxError(filename string, e *scanner.Error, lines []TangledLine) error {
+	if e.Pos.Line >= 1 && e.Pos.Line <= len(lines) {
+		if o, ok := lines[e.Pos.Line-1].Origin(e.Pos.Column - 1); ok {
+			return ErrorWithFile(o.Pos, "%s (in block `%s`, %s:%d:%d)",
+				e.Msg, o.Block, filename, e.Pos.Line, e.Pos.Column)
+		}
+	}
+	return e
+}
+
+// realignLines returns the lines of formatted, which is the text of lines
+// after gofmt, with the segments of the lines they were formatted from.
+// gofmt changes only the blanks in a line, so a formatted line comes from the
+// next line, in order, with the same text apart from blanks; lines it moves,
+// such as sorted imports, come from the first such line. Blank lines, and
+// lines that gofmt adds, have no segments.
+func realignLines(lines []TangledLine, formatted []byte) []TangledLine {
+	byText := make(map[string][]int)
+	for i, l := range lines {
+		key := withoutBlanks(l.Text)
+		byText[key] = append(byText[key], i)
+	}
+	text := strings.Split(strings.TrimSuffix(string(formatted), "\n"), "\n")
+	out := make([]TangledLine, len(text))
+	next := 0
+	for i, t := range text {
+		out[i].Text = t
+		key := withoutBlanks(t)
+		from := byText[key]
+		if key == "" || len(from) == 0 {
+			continue
+		}
+		j := from[0]
+		if k := sort.SearchInts(from, next); k < len(from) {
+			j = from[k]
+			next = j + 1
+		}
+		out[i].Segments = moveSegments(lines[j], t)
+	}
+	return out
+}
+
+// isBlank returns true if c is a space or a tab.
+func isBlank(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// withoutBlanks returns s with its spaces and tabs removed.
+func withoutBlanks(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// moveSegments returns the segments of l moved to the same places in text,
+// which is the text of l with different blanks. Since the blanks between two
+// pieces of a segment can change, a segment is split where they do, so that
+// every byte that is not blank keeps its column in the source. A line
+// directive stays with the segment it comes before.
+func moveSegments(l TangledLine, text string) []Segment {
+	out := make([]Segment, 0, len(l.Segments))
+	seg, old, delta := -1, 0, 0
+	for i := range len(text) {
+		if isBlank(text[i]) {
+			continue
+		}
+		for old < len(l.Text) && isBlank(l.Text[old]) {
+			old++
+		}
+		if old >= len(l.Text) {
+			break
+		}
+		moved := seg < 0 || old-i != delta
+		for seg+1 < len(l.Segments) && l.Segments[seg+1].Start-l.Segments[seg+1].directive <= old {
+			seg, moved = seg+1, true
+		}
+		if seg >= 0 && moved {
+			s := l.Segments[seg]
+			if old < s.Start {
+				// old is at the start of the line directive, which gofmt
+				// leaves as it is.
+				s.Start = i + s.Start - old
+			} else {
+				s.Col += old - s.Start
+				s.Start = i
+				s.directive = 0
+			}
+			out = append(out, s)
+			delta = old - i
+		}
+		old++
+	}
+	return out
+}
@@ -0,0 +1,143 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing/fstest"
+)
+
+//=================================================================================
+// Filesystems
+//=================================================================================
+
+// WriteFS is a filesystem that output files can be created in.
+type WriteFS interface {
+	// Create creates (or truncates) the named file. The contents are
+	// complete once the returned writer is closed.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// RemoveFS is a WriteFS that files can also be removed from.
+type RemoveFS interface {
+	WriteFS
+
+	// Remove removes the named file.
+	Remove(name string) error
+}
+
+// OSFS reads and writes the files of the operating system. Unlike os.DirFS,
+// names are interpreted exactly as os.Open interprets them, so they may be
+// absolute or contain "..".
+type OSFS struct{}
+
+// Open opens the named file for reading.
+func (OSFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// Create creates or truncates the named file.
+func (OSFS) Create(name string) (io.WriteCloser, error) {
+	return os.Create(name)
+}
+
+// Remove removes the named file.
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// MemFS is a WriteFS that keeps the files written to it in memory. It is also
+// an fs.FS, so the files can be read back (or read by another run). It is
+// safe for concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemFS creates an empty in-memory filesystem.
+func NewMemFS() *MemFS {
+	return &MemFS{files: make(map[string][]byte)}
+}
+
+// memFile collects the bytes written to a file until it is closed.
+type memFile struct {
+	bytes.Buffer
+	fsys *MemFS
+	name string
+}
+
+// Close stores the file's contents in its filesystem.
+func (f *memFile) Close() error {
+	f.fsys.mu.Lock()
+	defer f.fsys.mu.Unlock()
+	f.fsys.files[f.name] = bytes.Clone(f.Bytes())
+	return nil
+}
+
+// Create creates or truncates the named file.
+func (m *MemFS) Create(name string) (io.WriteCloser, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrInvalid}
+	}
+	return &memFile{fsys: m, name: name}, nil
+}
+
+// Remove removes the named file.
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+// Open opens the named file for reading. A directory holds the files whose
+// names start with its name.
+func (m *MemFS) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if data, ok := m.files[name]; ok {
+		return fstest.MapFS{name: &fstest.MapFile{Data: data, Mode: 0o644}}.Open(name)
+	}
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	dir := make(fstest.MapFS)
+	for n, data := range m.files {
+		if strings.HasPrefix(n, prefix) {
+			dir[n] = &fstest.MapFile{Data: data, Mode: 0o644}
+		}
+	}
+	return dir.Open(name)
+}
+
+// ReadFile returns the contents of the named file.
+func (m *MemFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return bytes.Clone(data), nil
+}
+
+// Names returns the sorted names of all the files in the filesystem.
+func (m *MemFS) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]string, 0, len(m.files))
+	for n := range m.files {
+		out = append(out, n)
+	}
+	slices.Sort(out)
+	return out
+}
@@ -0,0 +1,54 @@
+package glitter
+
+import (
+	"errors"
+	"io/fs"
+	"slices"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTangleMapFSToMemFS(t *testing.T) {
+	src := fstest.MapFS{
+		"pkg/a.gw":      {Data: []byte("@glitter top\n<<*>>=\n    package pkg\n    @include \"pkg/shared.gw\"\n")},
+		"pkg/b.gw":      {Data: []byte("@glitter top\n<<*>>=\n    package pkg\n    <<Body>>\n")},
+		"pkg/shared.gw": {Data: []byte("<<Body>>=\n    var x = 1\n")},
+		"pkg/notes.gw":  {Data: []byte("just notes\n")},
+	}
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Config["TangleLineRef"] = ""
+	ctx.Sources = src
+	out := NewMemFS()
+	ctx.Outputs = out
+
+	files, err := FindTangleFiles(ctx.Sources, []string{"pkg"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pkg/a.gw", "pkg/b.gw"}; !slices.Equal(files, want) {
+		t.Fatalf("FindTangleFiles() = %v, want %v", files, want)
+	}
+	if err := Tangle(files, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{MANIFEST_FILE, "pkg/a.go", "pkg/b.go"}; !slices.Equal(out.Names(), want) {
+		t.Fatalf("outputs = %v, want %v", out.Names(), want)
+	}
+	got, err := out.ReadFile("pkg/b.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "package pkg\nvar x = 1\n"; string(got) != want {
+		t.Errorf("pkg/b.go = %q, want %q", got, want)
+	}
+	if data, err := fs.ReadFile(out, "pkg/b.go"); err != nil || string(data) != string(got) {
+		t.Errorf("fs.ReadFile(MemFS) = %q, %v", data, err)
+	}
+	entries, err := fs.ReadDir(out, "pkg")
+	if err != nil || len(entries) != 2 || entries[0].Name() != "a.go" {
+		t.Errorf("fs.ReadDir(MemFS) = %v, %v", entries, err)
+	}
+	if _, err := out.Open("pkg/c.go"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("MemFS.Open of a missing file: %v", err)
+	}
+}
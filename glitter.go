@@ -0,0 +1,68 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+
+// Package glitter implements the Glitter literate programming system. It
+// provides a reader (GlitterScanner) that walks a set of glitter source files
+// following their @include lines, a Weaver that turns those sources into a
+// typesetable document, and a Tangler that turns them into compilable source
+// files.
+package glitter
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// MAX_INCLUDE_DEPTH is the maximum depth of includes that GlitterScanner
+	// supports.
+	MAX_INCLUDE_DEPTH = 20
+
+	// Extensions of known file types.
+	TANGLE_OUT_EXT = ".go"
+	GLITTER_EXT    = ".gw"
+
+	// MANIFEST_FILE is the file, in the outputs, that lists the files
+	// written by tangle.
+	MANIFEST_FILE = ".glitter-manifest"
+
+	// SOURCE_MAP_EXT is added to the name of a tangled file to give the name
+	// of its source map.
+	SOURCE_MAP_EXT = ".gwmap"
+)
+
+// errorRecursionTooDeep is thrown if we encounter too many @includes.
+var errorRecursionTooDeep = errors.New("include recursion depth exceeds maximum")
+
+// Void is an empty struct.
+type Void struct{}
+
+// StringSet is a set of strings. No, I don't want to make this generic.
+type StringSet struct {
+	items map[string]Void
+}
+
+// Global item to mark items that are present in the set.
+var setMember = Void{}
+
+// NewStringSet creates a new string set.
+func NewStringSet() StringSet {
+	return StringSet{
+		items: make(map[string]Void),
+	}
+}
+
+// Insert adds a string to the set. It cannot be removed.
+func (s *StringSet) Insert(i string) {
+	s.items[i] = setMember
+}
+
+// Contains return true if a string was previously Inserted.
+func (s *StringSet) Contains(i string) bool {
+	_, ok := s.items[i]
+	return ok
+}
+
+// ErrorWithFile returns a new error that includes the file position.
+func ErrorWithFile(pos FilePos, msg string, args ...any) error {
+	return fmt.Errorf(fmt.Sprintf("%s:%d: %s", pos.Filename(), pos.LineNo(), msg), args...)
+}
@@ -0,0 +1,40 @@
+// Client-side search over the code and text of a glitter site. The index is
+// loaded by search.js, which sets glitterSearchIndex, so that the site also
+// works when it is opened from the filesystem.
+(function () {
+  "use strict";
+
+  function search(query) {
+    var words = query.toLowerCase().split(/\s+/).filter(function (w) { return w !== ""; });
+    if (words.length === 0 || typeof glitterSearchIndex === "undefined") {
+      return [];
+    }
+    return glitterSearchIndex.filter(function (e) {
+      var s = (e.title + "\n" + e.text).toLowerCase();
+      return words.every(function (w) { return s.indexOf(w) >= 0; });
+    }).slice(0, 50);
+  }
+
+  function show(results, list) {
+    list.textContent = "";
+    results.forEach(function (e) {
+      var li = document.createElement("li");
+      var a = document.createElement("a");
+      a.href = e.page + (e.anchor ? "#" + e.anchor : "");
+      a.textContent = e.title;
+      li.appendChild(a);
+      list.appendChild(li);
+    });
+  }
+
+  document.addEventListener("DOMContentLoaded", function () {
+    var input = document.getElementById("glitter-search");
+    var list = document.getElementById("glitter-search-results");
+    if (!input || !list) {
+      return;
+    }
+    input.addEventListener("input", function () {
+      show(search(input.value), list);
+    });
+  });
+})();
@@ -0,0 +1,82 @@
+// This template implements the default formatting of `glitter weave -format
+// typst`. It is the Typst counterpart of glittertex.cls, and glitter copies
+// it into the start of every woven file.
+
+// The symbol that marks a code block that extends an earlier one.
+#let glitter-append-symbol = [+]
+
+// glitter-label returns the label of definition number series of block id.
+#let glitter-label(id, series) = label("glitter-" + str(id) + "-" + str(series))
+
+// glitter-page shows the page of the element with the given label, linked to
+// it, or ?? if there is no such element.
+#let glitter-page(lbl) = context {
+  let found = query(lbl)
+  if found.len() == 0 {
+    [??]
+  } else {
+    let loc = found.first().location()
+    link(loc, str(loc.page()))
+  }
+}
+
+// glitter-code-ref shows a reference to a code block: its name and the page of
+// its first definition. id is none for a block that is never defined.
+#let glitter-code-ref(id, name) = box[⟨#emph(name)#if id != none [ #text(size: 0.7em, glitter-page(glitter-label(id, 0)))]⟩]
+
+// glitter-code shows definition number series of block id: a header with the
+// block name, the pages of the blocks that use it and of its previous and next
+// definitions, then the numbered lines of code. Key blocks are added to the
+// list of key blocks.
+#let glitter-code(id, series, name, key: false, prev: false, next: false, usedin: (), lines) = {
+  let links = ()
+  if usedin.len() > 0 {
+    links.push([$in$ ] + usedin.map(u => glitter-page(glitter-label(u, 0))).join([, ]))
+  }
+  if prev {
+    links.push([$triangle.t$ ] + glitter-page(glitter-label(id, series - 1)))
+  }
+  if next {
+    links.push([$triangle.b$ ] + glitter-page(glitter-label(id, series + 1)))
+  }
+  let header = [⟨#emph(name)⟩#if series > 0 { glitter-append-symbol }$equiv$]
+  block(width: 100%, breakable: true, above: 1.2em, below: 1.2em, {
+    if key [#metadata(name)<glitter-key>]
+    grid(
+      columns: (1fr, auto),
+      header,
+      if links.len() > 0 { text(size: 0.8em, links.join(h(0.8em))) },
+    )
+    pad(left: 2em, grid(
+      columns: (auto, 1fr),
+      column-gutter: 1em,
+      row-gutter: 0.5em,
+      ..lines.enumerate().map(((i, l)) => (
+        text(size: 0.6em, fill: gray, str(i + 1)),
+        text(size: 0.9em, l),
+      )).flatten(),
+    ))
+  })
+}
+
+// glitter-key-list shows the list of key blocks, like \listofblock.
+#let glitter-key-list() = context {
+  let keys = query(<glitter-key>)
+  if keys.len() > 0 {
+    pagebreak(weak: true)
+    heading(outlined: false)[List of Key Blocks]
+    for k in keys {
+      link(k.location(), k.value)
+      box(width: 1fr, repeat[.])
+      str(k.location().page())
+      linebreak()
+    }
+  }
+}
+
+// glitter-book sets up the body of the document.
+#let glitter-book(body) = {
+  set page(paper: "us-letter", margin: 1in, numbering: "1")
+  set par(justify: true)
+  body
+}
@@ -1,3 +1,3 @@
 module monogrammedchalk.com/glitter
 
-go 1.21.1
+go 1.23
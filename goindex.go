@@ -0,0 +1,393 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"cmp"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+)
+
+//=================================================================================
+// Go index - where the Go declarations of a document are
+//=================================================================================
+
+// GoIndex records which code chunks end up in Go files, which chunks declare
+// the package-level functions, methods, types, variables and constants of
+// those files, and which chunks use them. It is built by tangling the
+// document in memory and type checking each package of Go outputs, so it only
+// knows about declarations that parse. Each identifier is resolved to what it
+// refers to, so local names, struct fields and the fields and methods picked
+// out by a selector are only uses of a declaration if they are that
+// declaration.
+type GoIndex struct {
+	decls  map[string][]*CodeChunk
+	uses   map[string][]*CodeChunk
+	goCode map[*CodeChunk]Void
+
+	// defines and usedBy list the names declared and used by each chunk.
+	defines map[*CodeChunk][]string
+	usedBy  map[*CodeChunk][]string
+
+	// idents holds the identifiers read from each line of the code chunks,
+	// in the order they are in the line.
+	idents map[FilePos][]goIdent
+}
+
+// GoName is a name declared at the package level of the Go files, with the
+// chunks that declare it and the other chunks that use it, in reading order.
+type GoName struct {
+	Name      string
+	DefinedIn []*CodeChunk
+	UsedIn    []*CodeChunk
+}
+
+// goIdent is an identifier read from a line of a code chunk: its byte offset
+// in the line, its name, and the chunk that declares the package-level name
+// it declares or refers to, or nil.
+type goIdent struct {
+	col  int
+	name string
+	decl *CodeChunk
+}
+
+// goFile is a parsed Go output, with the lines it was parsed from.
+type goFile struct {
+	fset  *token.FileSet
+	file  *ast.File
+	lines []TangledLine
+}
+
+// origin returns the segment that the identifier was read from, and its byte
+// offset in the source line.
+func (f *goFile) origin(id *ast.Ident) (Segment, int, bool) {
+	p := f.fset.Position(id.Pos())
+	if p.Line < 1 || p.Line > len(f.lines) {
+		return Segment{}, 0, false
+	}
+	s, ok := f.lines[p.Line-1].Origin(p.Column - 1)
+	return s, s.SourceCol(p.Column - 1), ok
+}
+
+// chunkOf returns the chunk that the identifier was read from, or nil.
+func (f *goFile) chunkOf(id *ast.Ident, chunkAt map[FilePos]*CodeChunk) *CodeChunk {
+	s, _, ok := f.origin(id)
+	if !ok {
+		return nil
+	}
+	return chunkAt[s.Pos]
+}
+
+// noImporter is a types.Importer that imports nothing. The index is only about
+// the names declared in the document, and the errors that checking code that
+// uses other packages gives are ignored.
+type noImporter struct{}
+
+// Import returns an error.
+func (noImporter) Import(path string) (*types.Package, error) {
+	return nil, fmt.Errorf("not importing %s", path)
+}
+
+// NewGoIndex tangles doc in memory and indexes the Go files it produces.
+// Files that cannot be tangled are skipped, and so are the parts of a file
+// that do not parse.
+func NewGoIndex(ctx *RunContext, doc *Document) *GoIndex {
+	x := &GoIndex{
+		decls:   make(map[string][]*CodeChunk),
+		uses:    make(map[string][]*CodeChunk),
+		goCode:  make(map[*CodeChunk]Void),
+		defines: make(map[*CodeChunk][]string),
+		usedBy:  make(map[*CodeChunk][]string),
+		idents:  make(map[FilePos][]goIdent),
+	}
+	tctx := NewRunContext(ModeTangle, ctx.GlitterOptions)
+	tctx.Config["TangleLineRef"] = ""
+	tctx.Logger = ctx.Logger
+	t := NewTangler(tctx)
+	t.AddDocument(doc)
+	files, err := t.OutputFiles()
+	if err != nil {
+		ctx.Info(1, "Not indexing Go code: %v", err)
+		return x
+	}
+
+	chunkAt := chunksByLine(doc)
+	fset := token.NewFileSet()
+	parsed := make([]*goFile, 0)
+	// the files of a package, which are those in the same directory with
+	// the same package name, are checked together.
+	packages := make(map[string][]*ast.File)
+	packageOrder := make([]string, 0)
+	for _, f := range files {
+		if path.Ext(f) != TANGLE_OUT_EXT {
+			continue
+		}
+		lines, err := t.TangleFile(f)
+		if err != nil {
+			ctx.Info(1, "Not indexing `%s`: %v", f, err)
+			continue
+		}
+		text := make([]string, len(lines))
+		for i, l := range lines {
+			text[i] = l.Text
+			for _, s := range l.Segments {
+				if c, ok := chunkAt[s.Pos]; ok {
+					x.goCode[c] = Void{}
+				}
+			}
+		}
+		file, _ := parser.ParseFile(fset, f, strings.Join(text, "\n"), parser.SkipObjectResolution)
+		if file == nil {
+			continue
+		}
+		parsed = append(parsed, &goFile{fset: fset, file: file, lines: lines})
+		key := path.Dir(f) + " " + file.Name.Name
+		if _, ok := packages[key]; !ok {
+			packageOrder = append(packageOrder, key)
+		}
+		packages[key] = append(packages[key], file)
+	}
+	info := &types.Info{
+		Defs: make(map[*ast.Ident]types.Object),
+		Uses: make(map[*ast.Ident]types.Object),
+	}
+	conf := types.Config{Importer: noImporter{}, Error: func(error) {}}
+	for _, key := range packageOrder {
+		conf.Check(key, fset, packages[key], info)
+	}
+
+	// find the declarations first, since a name may be used in a file
+	// before the file that declares it.
+	declaredIn := make(map[types.Object]*CodeChunk)
+	for _, f := range parsed {
+		for _, id := range declaredIdents(f.file) {
+			if c := f.chunkOf(id, chunkAt); c != nil {
+				x.decls[id.Name] = append(x.decls[id.Name], c)
+				x.defines[c] = append(x.defines[c], id.Name)
+				if obj := info.Defs[id]; obj != nil {
+					declaredIn[obj] = c
+				}
+			}
+		}
+	}
+	seen := make(map[*CodeChunk]map[string]Void)
+	for _, f := range parsed {
+		ast.Inspect(f.file, func(n ast.Node) bool {
+			id, ok := n.(*ast.Ident)
+			if !ok {
+				return true
+			}
+			s, col, ok := f.origin(id)
+			if !ok {
+				return true
+			}
+			// d is nil unless the identifier is a use of a declaration.
+			d := declaredIn[info.Uses[id]]
+			decl := cmp.Or(d, declaredIn[info.Defs[id]])
+			x.idents[s.Pos] = append(x.idents[s.Pos], goIdent{col: col, name: id.Name, decl: decl})
+			c := chunkAt[s.Pos]
+			if d == nil || c == nil || c == d {
+				return true
+			}
+			if seen[c] == nil {
+				seen[c] = make(map[string]Void)
+			}
+			if _, ok := seen[c][id.Name]; !ok {
+				seen[c][id.Name] = Void{}
+				x.uses[id.Name] = append(x.uses[id.Name], c)
+				x.usedBy[c] = append(x.usedBy[c], id.Name)
+			}
+			return true
+		})
+	}
+
+	// a line that is tangled more than once gives its identifiers more than
+	// once.
+	for pos, ids := range x.idents {
+		slices.SortStableFunc(ids, func(a, b goIdent) int { return cmp.Compare(a.col, b.col) })
+		x.idents[pos] = slices.CompactFunc(ids, func(a, b goIdent) bool { return a.col == b.col })
+	}
+	return x
+}
+
+// chunksByLine maps the position of every line of every code chunk of doc to
+// the chunk. If a file is read more than once, its first reading is used.
+func chunksByLine(doc *Document) map[FilePos]*CodeChunk {
+	out := make(map[FilePos]*CodeChunk)
+	for _, c := range doc.CodeChunks() {
+		for _, l := range c.Lines {
+			if _, ok := out[l.pos]; !ok {
+				out[l.pos] = c
+			}
+		}
+	}
+	return out
+}
+
+// declaredIdents returns the names declared at the package level of file,
+// including the names of methods but not the blank identifier or init.
+func declaredIdents(file *ast.File) []*ast.Ident {
+	out := make([]*ast.Ident, 0)
+	for _, d := range file.Decls {
+		switch d := d.(type) {
+		case *ast.FuncDecl:
+			if d.Name.Name != "init" && d.Name.Name != "_" {
+				out = append(out, d.Name)
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch spec := spec.(type) {
+				case *ast.TypeSpec:
+					out = append(out, spec.Name)
+				case *ast.ValueSpec:
+					for _, id := range spec.Names {
+						if id.Name != "_" {
+							out = append(out, id)
+						}
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// IsGo returns true if some line of the chunk is written to a Go file.
+func (x *GoIndex) IsGo(c *CodeChunk) bool {
+	_, ok := x.goCode[c]
+	return ok
+}
+
+// DeclarationAt returns the chunk that declares the package-level name that
+// identifier number n (counting from 0) of those called name on the line read
+// from pos declares or refers to. It returns nil if the identifier is
+// something else, such as a local variable or a field, or if the line is not
+// in a Go file.
+func (x *GoIndex) DeclarationAt(pos FilePos, name string, n int) *CodeChunk {
+	for _, id := range x.idents[pos] {
+		if id.name != name {
+			continue
+		}
+		if n == 0 {
+			return id.decl
+		}
+		n--
+	}
+	return nil
+}
+
+// Declaration returns the chunk that declares name, or nil if name is not
+// declared or is declared more than once (for example, as methods of two
+// types).
+func (x *GoIndex) Declaration(name string) *CodeChunk {
+	if d := x.decls[name]; len(d) == 1 {
+		return d[0]
+	}
+	return nil
+}
+
+// Names returns every declared name, sorted.
+func (x *GoIndex) Names() []*GoName {
+	out := make([]*GoName, 0, len(x.decls))
+	for _, name := range slices.Sorted(maps.Keys(x.decls)) {
+		out = append(out, &GoName{Name: name, DefinedIn: x.decls[name], UsedIn: x.uses[name]})
+	}
+	return out
+}
+
+// Defines returns the sorted names that the chunk declares.
+func (x *GoIndex) Defines(c *CodeChunk) []string {
+	return slices.Compact(slices.Sorted(slices.Values(x.defines[c])))
+}
+
+// Uses returns the sorted names, declared in other chunks, that the chunk
+// uses.
+func (x *GoIndex) Uses(c *CodeChunk) []string {
+	return slices.Sorted(slices.Values(x.usedBy[c]))
+}
+
+//=================================================================================
+// Weaving the index
+//=================================================================================
+
+// visibleBlock returns the information about the block of the chunk if the
+// chunk is woven, and nil otherwise.
+func (d *WeaveDocument) visibleBlock(c *CodeChunk) *WeaveBlockInfo {
+	info := d.blocks[c.Canonical]
+	if info == nil || !slices.Contains(info.defs, c) {
+		return nil
+	}
+	return info
+}
+
+// blockRefs returns references to the visible blocks of the chunks, with each
+// block referred to once.
+func (r *weaveRun) blockRefs(chunks []*CodeChunk) []*WeaveRef {
+	out := make([]*WeaveRef, 0)
+	seen := make(map[*WeaveBlockInfo]Void)
+	for _, c := range chunks {
+		info := r.wd.visibleBlock(c)
+		if _, ok := seen[info]; ok || info == nil {
+			continue
+		}
+		seen[info] = Void{}
+		out = append(out, r.newRef(info.Name(), c.Canonical, info, false))
+	}
+	return out
+}
+
+// weaveAnnotations sends, after a code chunk, the Go names the chunk
+// declares and the names declared elsewhere that it uses, each with the
+// block that declares it. Nothing is sent if there are no such names.
+func (r *weaveRun) weaveAnnotations(code *WeaveCode) error {
+	x := r.wd.GoIndex
+	defines, uses := x.Defines(code.Chunk), x.Uses(code.Chunk)
+	if len(defines) == 0 && len(uses) == 0 {
+		return nil
+	}
+	ann := &WeaveAnnotations{Code: code, Defines: defines, Uses: make([]WeaveUse, 0, len(uses))}
+	for _, name := range uses {
+		use := WeaveUse{Name: name}
+		if d := x.Declaration(name); d != nil {
+			if refs := r.blockRefs([]*CodeChunk{d}); len(refs) > 0 {
+				use.Decl = refs[0]
+			}
+		}
+		ann.Uses = append(ann.Uses, use)
+	}
+	return r.b.BlockAnnotations(r.w, ann)
+}
+
+// weaveIndex sends the index of the Go names declared in woven chunks, with
+// the blocks that declare each name and the blocks that use it. Nothing is
+// sent if there are no such names.
+func (r *weaveRun) weaveIndex() error {
+	r.at = len(r.wd.Doc.Chunks)
+	entries := make([]*WeaveIndexEntry, 0)
+	for _, n := range r.wd.GoIndex.Names() {
+		defs := r.blockRefs(n.DefinedIn)
+		if len(defs) > 0 {
+			entries = append(entries, &WeaveIndexEntry{Name: n.Name, DefinedIn: defs, UsedIn: r.blockRefs(n.UsedIn)})
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	err := r.b.BeginIndex(r.w)
+	for _, e := range entries {
+		if err != nil {
+			return err
+		}
+		err = r.b.IndexEntry(r.w, e)
+	}
+	if err == nil {
+		err = r.b.EndIndex(r.w)
+	}
+	return err
+}
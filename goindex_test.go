@@ -0,0 +1,155 @@
+package glitter
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const goIndexTestSource = `<<* "prog.go">>=
+    package main
+
+    func main() {
+        greet(greeting)
+    }
+
+    <<Greeting>>
+<<Greeting>>=
+    const greeting = "hi"
+
+    func greet(s string) {
+        greeting := s
+        println(greeting)
+    }
+`
+
+func TestGoIndex(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	doc, err := Parse(NewGlitterScannerFromReader("w.gw", strings.NewReader(goIndexTestSource), ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewGoIndex(ctx, doc)
+	code := doc.CodeChunks()
+	if got := x.Defines(code[1]); !slices.Equal(got, []string{"greet", "greeting"}) {
+		t.Errorf("Defines(greeting) = %v", got)
+	}
+	if got := x.Uses(code[0]); !slices.Equal(got, []string{"greet", "greeting"}) {
+		t.Errorf("Uses(main) = %v", got)
+	}
+	// the local greeting in greet is not a use of the constant.
+	if got := x.Uses(code[1]); len(got) != 0 {
+		t.Errorf("Uses(greeting) = %v", got)
+	}
+	names := x.Names()
+	if len(names) != 3 || names[0].Name != "greet" || names[0].DefinedIn[0] != code[1] ||
+		names[0].UsedIn[0] != code[0] || names[2].Name != "main" || len(names[2].UsedIn) != 0 {
+		t.Errorf("Names() = %+v", names)
+	}
+}
+
+const goIndexFieldsTestSource = `<<* "prog.go">>=
+    package main
+
+    <<Count>>
+    <<Counter>>
+    <<Tally>>
+<<Count>>=
+    func count() int { return 0 }
+<<Counter>>=
+    type counter struct {
+        count int
+    }
+
+    func (c *counter) add() {
+        c.count++
+    }
+<<Tally>>=
+    func tally() int {
+        x := counter{count: 1}
+        count := x.count
+        return count
+    }
+`
+
+func TestGoIndexFieldsAndSelectors(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	doc, err := Parse(NewGlitterScannerFromReader("w.gw", strings.NewReader(goIndexFieldsTestSource), ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := NewGoIndex(ctx, doc)
+	code := doc.CodeChunks()
+	// the field count, the key count:, the selector x.count and the local
+	// count are not uses of the function count.
+	if got := x.Uses(code[2]); len(got) != 0 {
+		t.Errorf("Uses(Counter) = %v", got)
+	}
+	if got := x.Uses(code[3]); !slices.Equal(got, []string{"counter"}) {
+		t.Errorf("Uses(Tally) = %v", got)
+	}
+	if names := x.Names(); names[1].Name != "count" || len(names[1].UsedIn) != 0 {
+		t.Errorf("Names() = %+v", names)
+	}
+}
+
+func TestWeaveGoIndexEvents(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	ctx.Config["WeaveIndex"] = "true"
+	b := &eventBackend{}
+	in := strings.NewReader(goIndexTestSource)
+	err := NewWeaverWithBackend(ctx, b).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"end code",
+		"annotations #1 defines=[main] uses=[greet #2 greeting #2]",
+	}
+	if i := slices.Index(b.events, "end code"); i < 0 || !slices.Equal(b.events[i:i+len(want)], want) {
+		t.Errorf("events =\n%s\nwant to contain\n%s", strings.Join(b.events, "\n"), strings.Join(want, "\n"))
+	}
+	want = []string{
+		"index",
+		"entry greet defined=[2] used=[1]",
+		"entry greeting defined=[2] used=[1]",
+		"entry main defined=[1] used=[]",
+		"end index",
+		"end document",
+	}
+	if !slices.Equal(b.events[len(b.events)-len(want):], want) {
+		t.Errorf("events =\n%s\nwant to end with\n%s", strings.Join(b.events, "\n"), strings.Join(want, "\n"))
+	}
+
+	ctx.Config["WeaveIndex"] = "false"
+	b = &eventBackend{}
+	in = strings.NewReader(goIndexTestSource)
+	err = NewWeaverWithBackend(ctx, b).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.ContainsFunc(b.events, func(e string) bool {
+		return e == "index" || strings.HasPrefix(e, "annotations")
+	}) {
+		t.Errorf("WeaveIndex=false sent the index:\n%s", strings.Join(b.events, "\n"))
+	}
+}
+
+func TestWeaveGoIndexLatex(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	ctx.Config["WeaveIndex"] = "true"
+	var out strings.Builder
+	in := strings.NewReader(goIndexTestSource)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\\end{lstlisting}\\glitterEndCode\n\\glitterAnnotations{Defines: \\lstinline@main@ Uses: \\lstinline@greet@ \\glitterCodeRef{Greeting}",
+		"\\section*{Index}\n\\glitterIndexEntry{\\lstinline@greet@: \\glitterCodeRef{Greeting}; used in \\glitterCodeRef{* \"prog.go\"}}\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,432 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"fmt"
+	"go/scanner"
+	"go/token"
+	"html"
+	"io"
+	"path"
+	"slices"
+	"strings"
+)
+
+//=================================================================================
+// HTML backend - a standalone, hyperlinked HTML document
+//=================================================================================
+
+// htmlStyle is the style sheet included in the head of every HTML document.
+const htmlStyle = `body { max-width: 50em; margin: 2em auto; padding: 0 1em; font-family: serif; line-height: 1.4; }
+.glitter-code { margin: 1em 0; }
+.glitter-code pre { margin: 0.2em 0 0 2em; font-size: 0.9em; }
+.glitter-header { display: flex; justify-content: space-between; }
+.glitter-links { font-size: 0.8em; }
+.glitter-links a, a.glitter-ref { text-decoration: none; }
+.glitter-ref-id, .glitter-id { font-size: 0.7em; }
+.glitter-key > .glitter-header .glitter-name { font-weight: bold; }
+.glitter-undefined { color: #b00; }
+:target { background: #ffd; }
+.glitter-kw { font-weight: bold; }
+.glitter-str { color: #070; }
+.glitter-num { color: #00a; }
+.glitter-com { color: #666; font-style: italic; }
+a.glitter-ident { color: inherit; text-decoration: none; border-bottom: 1px dotted #888; }
+.glitter-annotations { margin: -0.5em 0 1em 2em; font-size: 0.8em; }
+`
+
+// htmlBackend writes a standalone HTML document in which every code block has
+// an anchor and every reference links to the first definition of its block.
+type htmlBackend struct {
+	ctx *RunContext
+	doc *WeaveDocument
+
+	inCode bool
+	// lineEmpty and lastEmpty track blank lines in text, which separate
+	// paragraphs.
+	lineEmpty bool
+	lastEmpty bool
+	keyBlocks []*WeaveCode
+
+	// goIndex is the document's GoIndex.
+	goIndex *GoIndex
+	// goCode is true in a code chunk that holds Go.
+	goCode bool
+	// open is the text that ends a comment or raw string that is continued
+	// from the last piece of Go code, if any.
+	open string
+	// linePos is the position of the current line, and idents counts the
+	// identifiers of each name that have been written on it.
+	linePos FilePos
+	idents  map[string]int
+
+	// href, if not nil, gives the URL of a chunk, for documents that are
+	// split over several pages.
+	href func(id, series int) string
+}
+
+// newHTMLBackend creates an HTML backend for the given run.
+func newHTMLBackend(ctx *RunContext) Backend {
+	return &htmlBackend{ctx: ctx}
+}
+
+// htmlAnchor returns the id of the element that holds chunk number series of
+// the block with the given id. The ids match the labels of the LaTeX format.
+func htmlAnchor(id, series int) string {
+	return fmt.Sprintf("glitter-%d-%d", id, series)
+}
+
+// link returns the URL of chunk number series of the block with the given id.
+func (b *htmlBackend) link(id, series int) string {
+	if b.href != nil {
+		return b.href(id, series)
+	}
+	return "#" + htmlAnchor(id, series)
+}
+
+// blockLink returns a link to the first definition of the block, showing its
+// name and id.
+func (b *htmlBackend) blockLink(name string, info *WeaveBlockInfo) string {
+	if info == nil || len(info.Defs()) == 0 {
+		id, class := "??", "glitter-ref glitter-undefined"
+		if info != nil {
+			id = fmt.Sprint(info.Id())
+			if info.Defined() {
+				// only hidden chunks define it, so there is nothing to link to.
+				class = "glitter-ref"
+			}
+		}
+		return fmt.Sprintf(`<span class="%s">⟨%s <span class="glitter-ref-id">%s</span>⟩</span>`,
+			class, html.EscapeString(name), id)
+	}
+	return fmt.Sprintf(`<a class="glitter-ref" href="%s">⟨%s <span class="glitter-ref-id">%d</span>⟩</a>`,
+		b.link(info.Id(), 0), html.EscapeString(name), info.Id())
+}
+
+// begin prepares the backend to write doc.
+func (b *htmlBackend) begin(doc *WeaveDocument) {
+	b.doc = doc
+	b.keyBlocks = make([]*WeaveCode, 0)
+	b.goIndex = doc.GoIndex
+	b.idents = make(map[string]int)
+}
+
+// BeginDocument writes the head of the document. The preamble is meant for
+// the LaTeX format and is not written.
+func (b *htmlBackend) BeginDocument(w io.Writer, doc *WeaveDocument) error {
+	b.begin(doc)
+	title := "glitter"
+	if len(doc.Doc.Chunks) > 0 {
+		pos := doc.Doc.Chunks[0].Pos()
+		title = path.Base(pos.Filename())
+	}
+	_, err := fmt.Fprintf(w, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"+
+		"<title>%s</title>\n<style>\n%s</style>\n</head>\n<body>\n",
+		html.EscapeString(title), htmlStyle)
+	return err
+}
+
+// EndDocument writes the list of key blocks and closes the document.
+func (b *htmlBackend) EndDocument(w io.Writer, doc *WeaveDocument) error {
+	var sb strings.Builder
+	b.writeKeyBlocks(&sb)
+	sb.WriteString("</body>\n</html>\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeKeyBlocks writes the list of key blocks, if there are any.
+func (b *htmlBackend) writeKeyBlocks(sb *strings.Builder) {
+	if len(b.keyBlocks) > 0 {
+		sb.WriteString("<nav class=\"glitter-key-blocks\">\n<h2>Key Blocks</h2>\n<ul>\n")
+		for _, code := range b.keyBlocks {
+			fmt.Fprintf(sb, "<li><a href=\"%s\">%s</a></li>\n",
+				b.link(code.Id, code.Series), html.EscapeString(code.Chunk.Name))
+		}
+		sb.WriteString("</ul>\n</nav>\n")
+	}
+}
+
+// BeginText starts a paragraph.
+func (b *htmlBackend) BeginText(w io.Writer, chunk *TextChunk) error {
+	b.inCode = false
+	b.lastEmpty = false
+	_, err := io.WriteString(w, "<div class=\"glitter-text\">\n<p>")
+	return err
+}
+
+// EndText ends the paragraph.
+func (b *htmlBackend) EndText(w io.Writer, chunk *TextChunk) error {
+	_, err := io.WriteString(w, "</p>\n</div>\n")
+	return err
+}
+
+// BeginCode writes the anchor and header of the chunk: its name, the links to
+// the previous and next definitions of the block, and the links to the blocks
+// that use it.
+func (b *htmlBackend) BeginCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = true
+	b.goCode = b.goIndex.IsGo(code.Chunk)
+	b.open = ""
+	class := "glitter-code"
+	if code.Chunk.Key {
+		class += " glitter-key"
+		b.keyBlocks = append(b.keyBlocks, code)
+	}
+	eq := "≡"
+	if code.Series > 0 {
+		eq = "+≡"
+	}
+	links := make([]string, 0)
+	if code.Series > 0 {
+		links = append(links, fmt.Sprintf(`<a href="%s" title="previous definition">▴</a>`,
+			b.link(code.Id, code.Series-1)))
+	}
+	if code.Series+1 < len(code.Block.Defs()) {
+		links = append(links, fmt.Sprintf(`<a href="%s" title="next definition">▾</a>`,
+			b.link(code.Id, code.Series+1)))
+	}
+	if used := code.Block.UsedIn(); len(used) > 0 {
+		refs := make([]string, 0, len(used))
+		for _, id := range used {
+			info := b.doc.BlockById(id)
+			refs = append(refs, fmt.Sprintf(`<a href="%s" title="%s">%d</a>`,
+				b.link(id, 0), html.EscapeString(info.Name()), id))
+		}
+		links = append(links, "used in "+strings.Join(refs, ", "))
+	}
+	_, err := fmt.Fprintf(w, "<div class=\"%s\" id=\"%s\">\n<div class=\"glitter-header\">"+
+		"<span class=\"glitter-name\">⟨%s <span class=\"glitter-id\">%d</span>⟩%s</span>"+
+		"<span class=\"glitter-links\">%s</span></div>\n<pre><code>",
+		class, htmlAnchor(code.Id, code.Series), html.EscapeString(code.Chunk.Name), code.Id, eq,
+		strings.Join(links, " "))
+	return err
+}
+
+// EndCode closes the chunk.
+func (b *htmlBackend) EndCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = false
+	_, err := io.WriteString(w, "</code></pre>\n</div>\n")
+	return err
+}
+
+// BeginLine starts a line.
+func (b *htmlBackend) BeginLine(w io.Writer, pos FilePos) error {
+	b.lineEmpty = true
+	b.linePos = pos
+	clear(b.idents)
+	return nil
+}
+
+// EndLine ends a line. In text, a blank line ends the paragraph.
+func (b *htmlBackend) EndLine(w io.Writer) error {
+	s := "\n"
+	if !b.inCode && b.lineEmpty {
+		if b.lastEmpty {
+			return nil
+		}
+		s = "</p>\n<p>"
+	}
+	b.lastEmpty = !b.inCode && b.lineEmpty
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// Text writes s, escaped. Go code is highlighted.
+func (b *htmlBackend) Text(w io.Writer, s string) error {
+	if strings.TrimSpace(s) != "" {
+		b.lineEmpty = false
+	}
+	if b.inCode && b.goCode {
+		s = b.highlightGo(s)
+	} else {
+		s = html.EscapeString(s)
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// htmlSpan returns s, escaped, in a span of the given class.
+func htmlSpan(class, s string) string {
+	return `<span class="` + class + `">` + html.EscapeString(s) + "</span>"
+}
+
+// goTokenClass returns the class of the span that highlights a Go token, or
+// "" if it is not highlighted.
+func goTokenClass(tok token.Token) string {
+	switch {
+	case tok.IsKeyword():
+		return "glitter-kw"
+	case tok == token.STRING || tok == token.CHAR:
+		return "glitter-str"
+	case tok == token.INT || tok == token.FLOAT || tok == token.IMAG:
+		return "glitter-num"
+	case tok == token.COMMENT:
+		return "glitter-com"
+	}
+	return ""
+}
+
+// highlightGo returns a piece of Go code as HTML, with its tokens in spans
+// and the identifiers that declare or refer to names declared in the document
+// linked to the chunks that declare them. The pieces of a chunk are given in
+// order, so that comments and raw strings can continue from one line to the
+// next, and the identifiers of a line can be matched up with those the
+// GoIndex found on it.
+func (b *htmlBackend) highlightGo(s string) string {
+	var sb strings.Builder
+	if b.open != "" {
+		end := strings.Index(s, b.open)
+		class := "glitter-com"
+		if b.open == "`" {
+			class = "glitter-str"
+		}
+		if end < 0 {
+			return htmlSpan(class, s)
+		}
+		end += len(b.open)
+		sb.WriteString(htmlSpan(class, s[:end]))
+		s = s[end:]
+		b.open = ""
+	}
+
+	file := token.NewFileSet().AddFile("", -1, len(s))
+	var sc scanner.Scanner
+	sc.Init(file, []byte(s), func(token.Position, string) {}, scanner.ScanComments)
+	cp := 0
+	prev := token.ILLEGAL
+	for {
+		p, tok, lit := sc.Scan()
+		if tok == token.EOF {
+			break
+		}
+		// the package name is not a reference to a declaration.
+		isPackage := prev == token.PACKAGE
+		prev = tok
+		class := goTokenClass(tok)
+		if class == "" && tok != token.IDENT {
+			continue
+		}
+		off := file.Offset(p)
+		if lit == "" {
+			lit = tok.String()
+		}
+		sb.WriteString(html.EscapeString(s[cp:off]))
+		cp = off + len(lit)
+		switch {
+		case tok == token.IDENT && isPackage:
+			b.idents[lit]++
+			sb.WriteString(html.EscapeString(lit))
+			continue
+		case tok == token.IDENT:
+			sb.WriteString(b.identLink(lit, b.idents[lit]))
+			b.idents[lit]++
+			continue
+		case tok == token.COMMENT && strings.HasPrefix(lit, "/*") && (len(lit) < 4 || !strings.HasSuffix(lit, "*/")):
+			b.open = "*/"
+		case tok == token.STRING && strings.HasPrefix(lit, "`") && (len(lit) < 2 || !strings.HasSuffix(lit, "`")):
+			b.open = "`"
+		}
+		sb.WriteString(htmlSpan(class, lit))
+	}
+	sb.WriteString(html.EscapeString(s[cp:]))
+	return sb.String()
+}
+
+// identLink returns identifier number n of those called name on the current
+// line, escaped, and linked to the chunk that declares what it refers to if
+// that chunk is woven.
+func (b *htmlBackend) identLink(name string, n int) string {
+	c := b.goIndex.DeclarationAt(b.linePos, name, n)
+	if c == nil {
+		return html.EscapeString(name)
+	}
+	info := b.doc.Block(c.Canonical)
+	if info == nil {
+		return html.EscapeString(name)
+	}
+	series := slices.Index(info.Defs(), c)
+	if series < 0 {
+		return html.EscapeString(name)
+	}
+	return fmt.Sprintf(`<a class="glitter-ident" href="%s">%s</a>`,
+		b.link(info.Id(), series), html.EscapeString(name))
+}
+
+// CodeRef writes a link to the first definition of the referenced block.
+func (b *htmlBackend) CodeRef(w io.Writer, ref *WeaveRef) error {
+	b.lineEmpty = false
+	_, err := io.WriteString(w, b.blockLink(ref.Name, ref.Block))
+	return err
+}
+
+// InlineCode writes code in a <code> element.
+func (b *htmlBackend) InlineCode(w io.Writer, code string) error {
+	b.lineEmpty = false
+	_, err := io.WriteString(w, "<code>"+html.EscapeString(code)+"</code>")
+	return err
+}
+
+// blockLinks returns links to the blocks of refs, separated by commas.
+func (b *htmlBackend) blockLinks(refs []*WeaveRef) string {
+	links := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		links = append(links, b.blockLink(ref.Name, ref.Block))
+	}
+	return strings.Join(links, ", ")
+}
+
+// BlockAnnotations writes the names the chunk declares and uses in a
+// glitter-annotations note, with a link to the block that declares each use.
+func (b *htmlBackend) BlockAnnotations(w io.Writer, ann *WeaveAnnotations) error {
+	var sb strings.Builder
+	sb.WriteString("<div class=\"glitter-annotations\">")
+	if len(ann.Defines) > 0 {
+		names := make([]string, 0, len(ann.Defines))
+		for _, name := range ann.Defines {
+			names = append(names, "<code>"+html.EscapeString(name)+"</code>")
+		}
+		fmt.Fprintf(&sb, "%s %s", html.EscapeString(b.ctx.GetConfig("IndexDefines")), strings.Join(names, ", "))
+	}
+	if len(ann.Uses) > 0 {
+		if len(ann.Defines) > 0 {
+			sb.WriteString(" ")
+		}
+		names := make([]string, 0, len(ann.Uses))
+		for _, use := range ann.Uses {
+			name := "<code>" + html.EscapeString(use.Name) + "</code>"
+			if use.Decl != nil {
+				name += " " + b.blockLink(use.Decl.Name, use.Decl.Block)
+			}
+			names = append(names, name)
+		}
+		fmt.Fprintf(&sb, "%s %s", html.EscapeString(b.ctx.GetConfig("IndexUses")), strings.Join(names, ", "))
+	}
+	sb.WriteString("</div>\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// BeginIndex starts the index as a list under an IndexTitle heading.
+func (b *htmlBackend) BeginIndex(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "<nav class=\"glitter-index\">\n<h2>%s</h2>\n<ul>\n",
+		html.EscapeString(b.ctx.GetConfig("IndexTitle")))
+	return err
+}
+
+// IndexEntry writes an item with the name and links to the blocks that
+// declare and use it.
+func (b *htmlBackend) IndexEntry(w io.Writer, entry *WeaveIndexEntry) error {
+	s := "<li><code>" + html.EscapeString(entry.Name) + "</code>: " + b.blockLinks(entry.DefinedIn)
+	if len(entry.UsedIn) > 0 {
+		s += "; " + html.EscapeString(b.ctx.GetConfig("IndexUsedIn")) + " " + b.blockLinks(entry.UsedIn)
+	}
+	_, err := io.WriteString(w, s+"</li>\n")
+	return err
+}
+
+// EndIndex closes the list.
+func (b *htmlBackend) EndIndex(w io.Writer) error {
+	_, err := io.WriteString(w, "</ul>\n</nav>\n")
+	return err
+}
@@ -0,0 +1,153 @@
+package glitter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWeaveHTML(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	if err := ctx.SetFormat("html"); err != nil {
+		t.Fatal(err)
+	}
+	src := `@: See <<Block two>> & [[a < b]].
+<<Block one>>=
+    <<Block two>>
+<<Block two>>=
+    x := "<"
+<<Block two>>=
+    y := 2
+`
+	var out strings.Builder
+	in := strings.NewReader(src)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	html := out.String()
+	for _, want := range []string{
+		`<a class="glitter-ref" href="#glitter-1-0">⟨Block two <span class="glitter-ref-id">1</span>⟩</a> &amp; <code>a &lt; b</code>.`,
+		`<div class="glitter-code" id="glitter-2-0">`,
+		`<div class="glitter-code" id="glitter-1-0">`,
+		`<div class="glitter-code" id="glitter-1-1">`,
+		`<a href="#glitter-1-1" title="next definition">▾</a> used in <a href="#glitter-2-0" title="Block one">2</a>`,
+		`<a href="#glitter-1-0" title="previous definition">▴</a>`,
+		`⟨Block two <span class="glitter-id">1</span>⟩+≡`,
+		`x := &#34;&lt;&#34;`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("output does not contain %s:\n%s", want, html)
+		}
+	}
+	if ctx.GetConfig("WeaveCommand") != "" {
+		t.Errorf("html WeaveCommand = %q, want none", ctx.GetConfig("WeaveCommand"))
+	}
+}
+
+func TestWeaveHTMLGoLinks(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	if err := ctx.SetFormat("html"); err != nil {
+		t.Fatal(err)
+	}
+	src := `<<* "prog.go">>=
+    package main
+
+    func main() {
+        greet("hi") // say /* hi
+    }
+    <<Greeting>>
+<<Greeting>>=
+    func greet(s string) {
+        _ = s + ` + "`a\n        b`" + `
+    }
+<<* "notes.txt">>=
+    greet
+`
+	var out strings.Builder
+	in := strings.NewReader(src)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	html := out.String()
+	for _, want := range []string{
+		`<span class="glitter-kw">package</span> main`,
+		`<span class="glitter-kw">func</span> <a class="glitter-ident" href="#glitter-1-0">main</a>() {`,
+		`<a class="glitter-ident" href="#glitter-2-0">greet</a>(<span class="glitter-str">&#34;hi&#34;</span>) <span class="glitter-com">// say /* hi</span>`,
+		`<span class="glitter-kw">func</span> <a class="glitter-ident" href="#glitter-2-0">greet</a>(s string) {`,
+		"<span class=\"glitter-str\">`a</span>\n<span class=\"glitter-str\">    b`</span>",
+		"<pre><code>greet\n</code></pre>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("output does not contain %s:\n%s", want, html)
+		}
+	}
+}
+
+func TestWeaveHTMLGoLinksResolved(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	if err := ctx.SetFormat("html"); err != nil {
+		t.Fatal(err)
+	}
+	ctx.Config["WeaveIndex"] = "false"
+	src := `<<* "prog.go">>=
+    package main
+
+    func count() int { return 0 }
+
+    type counter struct {
+        count int
+    }
+
+    func tally() int {
+        x := counter{count: count()}
+        count := x.count
+        return count
+    }
+`
+	var out strings.Builder
+	in := strings.NewReader(src)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	html := out.String()
+	for _, want := range []string{
+		`<span class="glitter-kw">func</span> <a class="glitter-ident" href="#glitter-1-0">count</a>() int {`,
+		"\n    count int\n",
+		`x := <a class="glitter-ident" href="#glitter-1-0">counter</a>{count: <a class="glitter-ident" href="#glitter-1-0">count</a>()}`,
+		"\n    count := x.count\n",
+		"\n    <span class=\"glitter-kw\">return</span> count\n",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("output does not contain %s:\n%s", want, html)
+		}
+	}
+	if n := strings.Count(html, `">count</a>`); n != 2 {
+		t.Errorf("count is linked %d times, want 2:\n%s", n, html)
+	}
+}
+
+func TestWeaveHTMLGoIndex(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	ctx.Config["WeaveIndex"] = "true"
+	if err := ctx.SetFormat("html"); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	in := strings.NewReader(goIndexTestSource)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	html := out.String()
+	for _, want := range []string{
+		`<div class="glitter-annotations">Defines: <code>greet</code>, <code>greeting</code></div>`,
+		"<nav class=\"glitter-index\">\n<h2>Index</h2>\n<ul>\n<li><code>greet</code>: " +
+			`<a class="glitter-ref" href="#glitter-2-0">⟨Greeting <span class="glitter-ref-id">2</span>⟩</a>; used in ` +
+			`<a class="glitter-ref" href="#glitter-1-0">⟨* &#34;prog.go&#34; <span class="glitter-ref-id">1</span>⟩</a></li>`,
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("output does not contain %s:\n%s", want, html)
+		}
+	}
+	if strings.Contains(html, "<p>Index") {
+		t.Errorf("index title is a paragraph:\n%s", html)
+	}
+}
@@ -0,0 +1,273 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+//=================================================================================
+// LaTeX backend - the default weave format, driven by the config templates
+//=================================================================================
+
+// latexBackend writes the document using the templates in the configuration
+// (Start, StartText, CodeRef, ...). The defaults produce a LaTeX file that uses
+// the glittertex class.
+type latexBackend struct {
+	ctx *RunContext
+
+	// currentFilename is the file of the last line that was written, so that
+	// a WeaveLineRef is written when the file changes.
+	currentFilename string
+	inCode          bool
+}
+
+// newLatexBackend creates a LaTeX backend for the given run.
+func newLatexBackend(ctx *RunContext) Backend {
+	return &latexBackend{ctx: ctx}
+}
+
+// template returns the named configuration template with its `#` escapes
+// replaced.
+func (b *latexBackend) template(name string) string {
+	return replaceNoOpChars(b.ctx.GetConfig(name))
+}
+
+// BeginDocument writes Start, the preamble and StartBook.
+func (b *latexBackend) BeginDocument(w io.Writer, doc *WeaveDocument) error {
+	_, err := io.WriteString(w, b.ctx.GetConfig("Start")+"\n")
+	for _, l := range doc.Preamble {
+		if err != nil {
+			return err
+		}
+		if err = b.BeginLine(w, l.pos); err == nil {
+			_, err = io.WriteString(w, l.line+"\n")
+		}
+	}
+	if err == nil {
+		_, err = io.WriteString(w, b.ctx.GetConfig("StartBook")+"\n")
+	}
+	return err
+}
+
+// EndDocument writes EndBook.
+func (b *latexBackend) EndDocument(w io.Writer, doc *WeaveDocument) error {
+	_, err := io.WriteString(w, "\n"+b.ctx.GetConfig("EndBook")+"\n")
+	return err
+}
+
+// BeginText writes the position of the chunk and StartText.
+func (b *latexBackend) BeginText(w io.Writer, chunk *TextChunk) error {
+	b.currentFilename = chunk.pos.filename
+	b.inCode = false
+	_, err := io.WriteString(w, b.ctx.lineCommand(chunk.pos)+b.ctx.GetConfig("StartText"))
+	return err
+}
+
+// EndText writes EndText.
+func (b *latexBackend) EndText(w io.Writer, chunk *TextChunk) error {
+	_, err := io.WriteString(w, b.ctx.GetConfig("EndText"))
+	return err
+}
+
+// blockVars returns the template variables that describe a block: $blockid,
+// $ndefs (the number of visible chunks that define it), $usedin (the ids of
+// the blocks that refer to it, separated by commas), $outputfile (the file a
+// top-level block is written to) and $prevdef and $nextdef (the series of the
+// chunks given by prev and next, or "" if they are -1).
+func blockVars(info *WeaveBlockInfo, prev, next int) map[string]string {
+	used := make([]string, 0, len(info.referencedFrom))
+	for _, id := range info.UsedIn() {
+		used = append(used, strconv.Itoa(id))
+	}
+	series := func(n int) string {
+		if n < 0 {
+			return ""
+		}
+		return strconv.Itoa(n)
+	}
+	return map[string]string{
+		"blockid":    strconv.Itoa(info.Id()),
+		"ndefs":      strconv.Itoa(len(info.Defs())),
+		"usedin":     strings.Join(used, ","),
+		"outputfile": info.OutputFile(),
+		"prevdef":    series(prev),
+		"nextdef":    series(next),
+	}
+}
+
+// BeginCode writes the CodeSet options for the block, its position and
+// StartCode.
+func (b *latexBackend) BeginCode(w io.Writer, code *WeaveCode) error {
+	b.currentFilename = code.Chunk.pos.filename
+	b.inCode = true
+	next := code.Series + 1
+	if next == len(code.Block.Defs()) {
+		next = -1
+	}
+	vars := blockVars(code.Block, code.Series-1, next)
+	vars["blocktable"] = strconv.FormatBool(code.Chunk.Key)
+	vars["blockseries"] = strconv.Itoa(code.Series)
+	setcmd := expandVars(b.ctx.GetConfig("CodeSet"), vars)
+	_, err := io.WriteString(w, setcmd+"\n"+
+		b.ctx.lineCommand(code.Chunk.pos)+
+		strings.Replace(b.ctx.GetConfig("StartCode"), "$1", code.Chunk.Name, 1)+"\n")
+	return err
+}
+
+// EndCode writes EndCode.
+func (b *latexBackend) EndCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = false
+	_, err := io.WriteString(w, b.ctx.GetConfig("EndCode"))
+	return err
+}
+
+// BeginLine writes a WeaveLineRef if a text line comes from a new file.
+// Nothing can be written inside a listing, so code lines are not marked.
+func (b *latexBackend) BeginLine(w io.Writer, pos FilePos) error {
+	if b.inCode || pos.filename == b.currentFilename {
+		return nil
+	}
+	b.currentFilename = pos.filename
+	_, err := io.WriteString(w, b.ctx.lineCommand(pos))
+	return err
+}
+
+// EndLine ends the line.
+func (b *latexBackend) EndLine(w io.Writer) error {
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Text writes s. In code, the CodeEscape character is replaced by
+// CodeEscape EscapeSub CodeEscape.
+func (b *latexBackend) Text(w io.Writer, s string) error {
+	if b.inCode {
+		esc := b.ctx.GetConfig("CodeEscape")
+		s = strings.ReplaceAll(s, esc, esc+b.ctx.GetConfig("EscapeSub")+esc)
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// refTemplate returns the template for a reference: CodeCodeRef in code and
+// TextCodeRef in text if they are set, or else CodeRef. The CodeRef template
+// is surrounded by CodeEscape in code, while CodeCodeRef must include it.
+func (b *latexBackend) refTemplate(inCode bool) (tt string, escaped bool) {
+	name := "TextCodeRef"
+	if inCode {
+		name = "CodeCodeRef"
+	}
+	if b.ctx.GetConfig(name) != "" {
+		return b.template(name), true
+	}
+	return b.template("CodeRef"), !inCode
+}
+
+// CodeRef writes the CodeRef template.
+func (b *latexBackend) CodeRef(w io.Writer, ref *WeaveRef) error {
+	_, err := io.WriteString(w, b.codeRef(ref))
+	return err
+}
+
+// codeRef returns the CodeRef template for the reference. A block that is
+// only defined in hidden chunks has no chunk to refer to, so its $blockid is
+// empty.
+func (b *latexBackend) codeRef(ref *WeaveRef) string {
+	// We handle lstlisting's tex escape character. That package will let us
+	// use latex in a code block, but we have to choose a character that means
+	// start and end the tex region. E.g. @\glitterCodeRef{foo}@. But we need a
+	// character that does not appear in the code block.
+	//
+	// Since /any/ character could appear in a string literal, we have to do
+	// some acrobatics. We set the escape character to @, surround our code ref
+	// latex command with @ @, and replace any real @ characters with
+	// @\glitterHash@ (or @ by EscapeSub inside the ref).
+	name := ref.Name
+	if ref.InCode {
+		name = strings.ReplaceAll(name, b.ctx.GetConfig("CodeEscape"), b.ctx.GetConfig("EscapeSub"))
+	}
+	tt, escaped := b.refTemplate(ref.InCode)
+	esc := ""
+	if !escaped {
+		esc = b.ctx.GetConfig("CodeEscape")
+	}
+	vars := blockVars(ref.Block, ref.Prev, ref.Next)
+	if len(ref.Block.Defs()) == 0 && ref.Block.Defined() {
+		vars["blockid"] = ""
+	}
+	vars["name"] = name
+	vars["1"] = name
+	return esc + expandVars(tt, vars) + esc
+}
+
+// InlineCode writes the InlineCode template.
+func (b *latexBackend) InlineCode(w io.Writer, code string) error {
+	_, err := io.WriteString(w, b.inlineCode(code))
+	return err
+}
+
+// inlineCode returns the InlineCode template for code.
+func (b *latexBackend) inlineCode(code string) string {
+	return expandVars(b.template("InlineCode"), map[string]string{"1": code})
+}
+
+// codeRefs returns the references, separated by commas.
+func (b *latexBackend) codeRefs(refs []*WeaveRef) string {
+	out := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		out = append(out, b.codeRef(ref))
+	}
+	return strings.Join(out, ", ")
+}
+
+// BlockAnnotations writes the Annotations template. Its argument lists the
+// names the chunk declares after IndexDefines, and the names it uses, each
+// with a reference to the block that declares it, after IndexUses.
+func (b *latexBackend) BlockAnnotations(w io.Writer, ann *WeaveAnnotations) error {
+	parts := make([]string, 0, 2)
+	if len(ann.Defines) > 0 {
+		names := make([]string, 0, len(ann.Defines))
+		for _, name := range ann.Defines {
+			names = append(names, b.inlineCode(name))
+		}
+		parts = append(parts, b.ctx.GetConfig("IndexDefines")+" "+strings.Join(names, ", "))
+	}
+	if len(ann.Uses) > 0 {
+		names := make([]string, 0, len(ann.Uses))
+		for _, use := range ann.Uses {
+			name := b.inlineCode(use.Name)
+			if use.Decl != nil {
+				name += " " + b.codeRef(use.Decl)
+			}
+			names = append(names, name)
+		}
+		parts = append(parts, b.ctx.GetConfig("IndexUses")+" "+strings.Join(names, ", "))
+	}
+	vars := map[string]string{"1": strings.Join(parts, " ")}
+	_, err := io.WriteString(w, expandVars(b.template("Annotations"), vars))
+	return err
+}
+
+// BeginIndex writes IndexTitle.
+func (b *latexBackend) BeginIndex(w io.Writer) error {
+	_, err := io.WriteString(w, b.ctx.GetConfig("IndexTitle")+"\n")
+	return err
+}
+
+// IndexEntry writes the IndexEntry template. Its argument is the name, the
+// blocks that declare it and, after IndexUsedIn, the blocks that use it.
+func (b *latexBackend) IndexEntry(w io.Writer, entry *WeaveIndexEntry) error {
+	s := b.inlineCode(entry.Name) + ": " + b.codeRefs(entry.DefinedIn)
+	if len(entry.UsedIn) > 0 {
+		s += "; " + b.ctx.GetConfig("IndexUsedIn") + " " + b.codeRefs(entry.UsedIn)
+	}
+	_, err := io.WriteString(w, expandVars(b.template("IndexEntry"), map[string]string{"1": s}))
+	return err
+}
+
+// EndIndex does nothing.
+func (b *latexBackend) EndIndex(w io.Writer) error {
+	return nil
+}
@@ -0,0 +1,184 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+)
+
+//=================================================================================
+// Manifest - the files written by tangle
+//=================================================================================
+
+// manifestEntry is a file written by tangle: its name, the glitter file its
+// first top-level block was read from, and the checksum of what was written.
+type manifestEntry struct {
+	File   string
+	Source string
+	Sum    string
+}
+
+// checksum returns the hex SHA-256 of data.
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readManifest returns the entries of the manifest in the run's Outputs. There
+// are none if there is no manifest or the Outputs cannot be read.
+func readManifest(ctx *RunContext) ([]manifestEntry, error) {
+	fsys, ok := ctx.Outputs.(fs.FS)
+	if !ok {
+		return nil, nil
+	}
+	data, err := fs.ReadFile(fsys, MANIFEST_FILE)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	out := make([]manifestEntry, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected checksum, file and source separated by tabs", MANIFEST_FILE, n)
+		}
+		out = append(out, manifestEntry{Sum: fields[0], File: fields[1], Source: fields[2]})
+	}
+	return out, scanner.Err()
+}
+
+// manifestEntryFor returns the entry of the manifest of the run's Outputs for
+// filename, and false if there is none.
+func manifestEntryFor(ctx *RunContext, filename string) (manifestEntry, bool, error) {
+	entries, err := readManifest(ctx)
+	if err != nil {
+		return manifestEntry{}, false, err
+	}
+	i := slices.IndexFunc(entries, func(e manifestEntry) bool { return path.Clean(e.File) == path.Clean(filename) })
+	if i < 0 {
+		return manifestEntry{}, false, nil
+	}
+	return entries[i], true, nil
+}
+
+// writeManifest writes the entries to the manifest in the run's Outputs, if
+// they have changed.
+func writeManifest(ctx *RunContext, entries []manifestEntry) error {
+	var buf bytes.Buffer
+	buf.WriteString("# Files written by glitter tangle: checksum, file and source, separated by tabs.\n")
+	for _, e := range entries {
+		fmt.Fprintf(&buf, "%s\t%s\t%s\n", e.Sum, e.File, e.Source)
+	}
+	_, _, err := writeIfChanged(ctx.Outputs, MANIFEST_FILE, buf.Bytes())
+	return err
+}
+
+// isStale returns true if the file of a manifest entry should have been
+// written by this tangle but was not: its source was read, or no longer
+// exists. Files from sources that were not read belong to other runs.
+func (t *Tangler) isStale(e manifestEntry, tangled map[string]Void) bool {
+	if _, ok := tangled[e.File]; ok {
+		return false
+	}
+	if _, ok := t.sources[e.Source]; ok {
+		return true
+	}
+	_, err := fs.Stat(t.ctx.Sources, e.Source)
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+// removeStale removes the files listed in the old manifest that this tangle
+// no longer writes, and returns the entries of those that are kept. A file
+// is kept, and reported, if it has been changed since it was written or if
+// the Outputs cannot remove files.
+func (t *Tangler) removeStale(old []manifestEntry, tangled map[string]Void) ([]manifestEntry, error) {
+	kept := make([]manifestEntry, 0)
+	remover, canRemove := t.ctx.Outputs.(RemoveFS)
+	fsys, _ := t.ctx.Outputs.(fs.FS)
+	for _, e := range old {
+		if !t.isStale(e, tangled) {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, e.File)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			continue
+		case err != nil:
+			return nil, err
+		case !canRemove:
+			t.ctx.Info(0, "`%s` is no longer generated; remove it by hand", e.File)
+		case checksum(data) != e.Sum:
+			t.ctx.Info(0, "`%s` is no longer generated but has been changed; not removing it", e.File)
+		default:
+			if err := remover.Remove(e.File); err != nil {
+				return nil, err
+			}
+			t.ctx.Info(1, "Removed `%s`, which is no longer generated", e.File)
+			t.summary.Removed++
+			continue
+		}
+		kept = append(kept, e)
+	}
+	return kept, nil
+}
+
+// Clean removes the files listed in the manifest of the run's Outputs, and
+// the manifest itself. A file that has been changed since it was written is
+// kept, and reported, and the manifest then lists only the files kept.
+func Clean(ctx *RunContext) error {
+	remover, ok := ctx.Outputs.(RemoveFS)
+	if !ok {
+		return errors.New("cannot remove files from the outputs")
+	}
+	fsys, ok := ctx.Outputs.(fs.FS)
+	if !ok {
+		return errors.New("cannot read files from the outputs")
+	}
+	entries, err := readManifest(ctx)
+	if err != nil {
+		return err
+	}
+	kept := make([]manifestEntry, 0)
+	removed := 0
+	for _, e := range entries {
+		data, err := fs.ReadFile(fsys, e.File)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			continue
+		case err != nil:
+			return err
+		case checksum(data) != e.Sum:
+			ctx.Info(0, "`%s` has been changed; not removing it", e.File)
+			kept = append(kept, e)
+			continue
+		}
+		if err := remover.Remove(e.File); err != nil {
+			return err
+		}
+		ctx.Info(1, "Removed `%s`", e.File)
+		removed++
+	}
+	if len(kept) > 0 {
+		if err := writeManifest(ctx, kept); err != nil {
+			return err
+		}
+	} else if err := remover.Remove(MANIFEST_FILE); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	ctx.Info(0, "removed %d files", removed)
+	return nil
+}
@@ -0,0 +1,260 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+//=================================================================================
+// Markdown backend - GitHub-flavored Markdown
+//=================================================================================
+
+// backtickRegex matches runs of backticks, to choose fences that are longer
+// than any run in the fenced text.
+var backtickRegex = regexp.MustCompile("`+")
+
+// markdownBackend writes GitHub-flavored Markdown. Text is passed through,
+// code chunks become fenced code blocks under a bold header, and references
+// link to an anchor before the first definition of their block.
+type markdownBackend struct {
+	ctx *RunContext
+
+	inCode bool
+	// startOfText is true until the first text of a text chunk has been
+	// written.
+	startOfText bool
+	fence       string
+	// refs holds the blocks referred to in the current code chunk.
+	refs []*WeaveRef
+}
+
+// newMarkdownBackend creates a Markdown backend for the given run.
+func newMarkdownBackend(ctx *RunContext) Backend {
+	return &markdownBackend{ctx: ctx}
+}
+
+// markdownFence returns a string of n backticks, where n is at least 3 and
+// longer than any run of backticks in the lines.
+func markdownFence(lines []ChunkLine) string {
+	n := 3
+	for _, l := range lines {
+		for _, run := range backtickRegex.FindAllString(l.line, -1) {
+			n = max(n, len(run)+1)
+		}
+	}
+	return strings.Repeat("`", n)
+}
+
+// markdownRef returns the name and id of a block, linked to its first
+// definition if it has one.
+func markdownRef(name string, info *WeaveBlockInfo) string {
+	if info == nil {
+		return fmt.Sprintf("⟨%s ??⟩", name)
+	}
+	if len(info.Defs()) == 0 {
+		return fmt.Sprintf("⟨%s %d⟩", name, info.Id())
+	}
+	return fmt.Sprintf("[⟨%s %d⟩](#%s)", name, info.Id(), htmlAnchor(info.Id(), 0))
+}
+
+// BeginDocument does nothing. The preamble is meant for the LaTeX format and
+// is not written.
+func (b *markdownBackend) BeginDocument(w io.Writer, doc *WeaveDocument) error {
+	return nil
+}
+
+// EndDocument does nothing.
+func (b *markdownBackend) EndDocument(w io.Writer, doc *WeaveDocument) error {
+	return nil
+}
+
+// BeginText starts a paragraph.
+func (b *markdownBackend) BeginText(w io.Writer, chunk *TextChunk) error {
+	b.inCode = false
+	b.startOfText = true
+	return nil
+}
+
+// EndText ends the paragraph.
+func (b *markdownBackend) EndText(w io.Writer, chunk *TextChunk) error {
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// BeginCode writes an anchor, the bold header of the chunk with links to the
+// other definitions of the block and the blocks it is used in, and opens a
+// fenced code block.
+func (b *markdownBackend) BeginCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = true
+	b.refs = make([]*WeaveRef, 0)
+	b.fence = markdownFence(code.Chunk.Lines)
+
+	eq := "≡"
+	if code.Series > 0 {
+		eq = "+≡"
+	}
+	links := make([]string, 0)
+	if code.Series > 0 {
+		links = append(links, fmt.Sprintf("[▴](#%s)", htmlAnchor(code.Id, code.Series-1)))
+	}
+	if code.Series+1 < len(code.Block.Defs()) {
+		links = append(links, fmt.Sprintf("[▾](#%s)", htmlAnchor(code.Id, code.Series+1)))
+	}
+	if used := code.Block.UsedIn(); len(used) > 0 {
+		refs := make([]string, 0, len(used))
+		for _, id := range used {
+			refs = append(refs, fmt.Sprintf("[%d](#%s)", id, htmlAnchor(id, 0)))
+		}
+		links = append(links, "used in "+strings.Join(refs, ", "))
+	}
+	header := fmt.Sprintf("<a id=\"%s\"></a>**⟨%s %d⟩%s**",
+		htmlAnchor(code.Id, code.Series), markdownEscape(code.Chunk.Name), code.Id, eq)
+	if len(links) > 0 {
+		header += " " + strings.Join(links, " ")
+	}
+	_, err := fmt.Fprintf(w, "%s\n\n%sgo\n", header, b.fence)
+	return err
+}
+
+// EndCode closes the fenced code block and, since links cannot appear inside
+// it, lists links to the blocks it refers to.
+func (b *markdownBackend) EndCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = false
+	s := b.fence + "\n\n"
+	if len(b.refs) > 0 {
+		links := make([]string, 0, len(b.refs))
+		for _, ref := range b.refs {
+			links = append(links, markdownRef(markdownEscape(ref.Name), ref.Block))
+		}
+		s += "Uses " + strings.Join(links, ", ") + ".\n\n"
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// BeginLine does nothing.
+func (b *markdownBackend) BeginLine(w io.Writer, pos FilePos) error {
+	return nil
+}
+
+// EndLine ends the line.
+func (b *markdownBackend) EndLine(w io.Writer) error {
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Text writes s as it is. The space after the `@:` that starts a text chunk
+// is removed so that the first line is not taken to be indented code.
+func (b *markdownBackend) Text(w io.Writer, s string) error {
+	if b.startOfText {
+		s = strings.TrimLeft(s, " \t")
+		b.startOfText = s == ""
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// CodeRef writes a link to the referenced block in text. In code, where links
+// are not possible, it writes the name and id of the block.
+func (b *markdownBackend) CodeRef(w io.Writer, ref *WeaveRef) error {
+	b.startOfText = false
+	if b.inCode {
+		b.refs = append(b.refs, ref)
+		_, err := fmt.Fprintf(w, "⟨%s %d⟩", ref.Name, ref.Id)
+		return err
+	}
+	_, err := io.WriteString(w, markdownRef(markdownEscape(ref.Name), ref.Block))
+	return err
+}
+
+// InlineCode writes code between backticks.
+func (b *markdownBackend) InlineCode(w io.Writer, code string) error {
+	b.startOfText = false
+	_, err := io.WriteString(w, markdownCode(code))
+	return err
+}
+
+// markdownCode returns code between enough backticks to hold it.
+func markdownCode(code string) string {
+	n := 1
+	for _, run := range backtickRegex.FindAllString(code, -1) {
+		n = max(n, len(run)+1)
+	}
+	fence := strings.Repeat("`", n)
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+		code = " " + code + " "
+	}
+	return fence + code + fence
+}
+
+// markdownRefs returns links to the blocks of refs, separated by commas.
+func markdownRefs(refs []*WeaveRef) string {
+	links := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		links = append(links, markdownRef(markdownEscape(ref.Name), ref.Block))
+	}
+	return strings.Join(links, ", ")
+}
+
+// BlockAnnotations writes a paragraph with the names the chunk declares and
+// uses, with a link to the block that declares each use.
+func (b *markdownBackend) BlockAnnotations(w io.Writer, ann *WeaveAnnotations) error {
+	parts := make([]string, 0, 2)
+	if len(ann.Defines) > 0 {
+		names := make([]string, 0, len(ann.Defines))
+		for _, name := range ann.Defines {
+			names = append(names, markdownCode(name))
+		}
+		parts = append(parts, b.ctx.GetConfig("IndexDefines")+" "+strings.Join(names, ", "))
+	}
+	if len(ann.Uses) > 0 {
+		names := make([]string, 0, len(ann.Uses))
+		for _, use := range ann.Uses {
+			name := markdownCode(use.Name)
+			if use.Decl != nil {
+				name += " " + markdownRef(markdownEscape(use.Decl.Name), use.Decl.Block)
+			}
+			names = append(names, name)
+		}
+		parts = append(parts, b.ctx.GetConfig("IndexUses")+" "+strings.Join(names, ", "))
+	}
+	_, err := io.WriteString(w, strings.Join(parts, " ")+"\n\n")
+	return err
+}
+
+// BeginIndex writes IndexTitle, which is a heading by default.
+func (b *markdownBackend) BeginIndex(w io.Writer) error {
+	_, err := io.WriteString(w, b.ctx.GetConfig("IndexTitle")+"\n\n")
+	return err
+}
+
+// IndexEntry writes a list item with the name and links to the blocks that
+// declare and use it.
+func (b *markdownBackend) IndexEntry(w io.Writer, entry *WeaveIndexEntry) error {
+	s := "- " + markdownCode(entry.Name) + ": " + markdownRefs(entry.DefinedIn)
+	if len(entry.UsedIn) > 0 {
+		s += "; " + b.ctx.GetConfig("IndexUsedIn") + " " + markdownRefs(entry.UsedIn)
+	}
+	_, err := io.WriteString(w, s+"\n")
+	return err
+}
+
+// EndIndex ends the list.
+func (b *markdownBackend) EndIndex(w io.Writer) error {
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// markdownEscaper escapes the characters that would change the meaning of a
+// block name in Markdown.
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`,
+)
+
+// markdownEscape escapes a block name for use in Markdown text.
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
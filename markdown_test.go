@@ -0,0 +1,50 @@
+package glitter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWeaveMarkdown(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	if err := ctx.SetFormat("markdown"); err != nil {
+		t.Fatal(err)
+	}
+	src := "@:    See <<Block two>> and [[a`b]].\n" +
+		"<<Block one>>=\n" +
+		"    <<Block two>>\n" +
+		"<<Block two>>=\n" +
+		"    s := ```\n" +
+		"<<Block two>>=\n" +
+		"    y := 2\n"
+	var out strings.Builder
+	in := strings.NewReader(src)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "See [⟨Block two 1⟩](#glitter-1-0) and ``a`b``.\n" +
+		"\n" +
+		"<a id=\"glitter-2-0\"></a>**⟨Block one 2⟩≡**\n" +
+		"\n" +
+		"```go\n" +
+		"⟨Block two 1⟩\n" +
+		"```\n" +
+		"\n" +
+		"Uses [⟨Block two 1⟩](#glitter-1-0).\n" +
+		"\n" +
+		"<a id=\"glitter-1-0\"></a>**⟨Block two 1⟩≡** [▾](#glitter-1-1) used in [2](#glitter-2-0)\n" +
+		"\n" +
+		"````go\n" +
+		"s := ```\n" +
+		"````\n" +
+		"\n" +
+		"<a id=\"glitter-1-1\"></a>**⟨Block two 1⟩+≡** [▴](#glitter-1-0) used in [2](#glitter-2-0)\n" +
+		"\n" +
+		"```go\n" +
+		"y := 2\n" +
+		"```\n" +
+		"\n"
+	if out.String() != want {
+		t.Errorf("output =\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,142 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// weaveConfigRegex gives a pattern to match in configuration files.
+var weaveConfigRegex = regexp.MustCompile(`^%%glitter\s+(\S+)\s+(.*)$`)
+
+// newlineRegex matches `$n` together with the rest of the variable name it
+// may start, such as `$nextdef`.
+var newlineRegex = regexp.MustCompile(`\$n[A-Za-z0-9_]*`)
+
+// GlitterOptions stores the options that control how sources are read, woven
+// and tangled.
+type GlitterOptions struct {
+	Verbose                  int
+	DisallowMultipleIncludes bool
+
+	// MaxTangleSize is the largest number of bytes that tangle will expand
+	// an output file to, or 0 for no limit.
+	MaxTangleSize int
+
+	// FormatGo runs gofmt on the Go files written by tangle.
+	FormatGo bool
+
+	// SourceMaps writes, next to each file written by tangle, a source map
+	// that gives where each of its lines came from.
+	SourceMaps bool
+
+	Config map[string]string
+}
+
+// NewGlitterOptions returns a new options struct with the defaults.
+func NewGlitterOptions() GlitterOptions {
+	shell := os.Getenv("SHELL")
+	if shell == "" {
+		shell = "sh"
+	}
+	o := GlitterOptions{
+		MaxTangleSize: 64 << 20,
+		Config: map[string]string{
+			"Start":     `\documentclass{glittertex}`,
+			"StartBook": `\glitterStartBook`,
+			"EndBook":   `\glitterEndBook`,
+			"StartText": `\glitterStartText`,
+			"EndText":   `\glitterEndText$n`,
+
+			// Note that \begin{lstlisting} apparently must be the first
+			// command on a LaTeX line.
+			"StartCode":     `\glitterStartCode{$1}$n\begin{lstlisting}`,
+			"EndCode":       `\end{lstlisting}\glitterEndCode$n`,
+			"CodeEscape":    `@`,
+			"CodeRef":       `\glitterCodeRef{$1}`,
+			"EscapeSub":     `{\glitterHash}`,
+			"InlineCode":    `\lstinline@$1@`,
+			"CodeSet":       `\glitterSet{blocktable=$blocktable,blockid=$blockid,blockseries=$blockseries}`,
+			"WeaveLineRef":  `%%line $lineno "$filename"$n`,
+			"TangleLineRef": `/*line $filename:$lineno*/`,
+			"Shell":         shell,
+			"WeaveCommand":  `pdflatex "${weavefile}" && pdflatex "${weavefile}"`,
+			"TangleCommand": `go build`,
+			"WeaveIndex":    `false`,
+			"IndexTitle":    `\section*{Index}`,
+			"IndexDefines":  `Defines:`,
+			"IndexUses":     `Uses:`,
+			"IndexUsedIn":   `used in`,
+			"Annotations":   `\glitterAnnotations{$1}$n`,
+			"IndexEntry":    `\glitterIndexEntry{$1}$n`,
+		},
+	}
+	for k, v := range o.Config {
+		o.Config[k] = expandNewlines(v)
+	}
+	return o
+}
+
+// ReadConfig reads a file with the weave configure options. It also sets
+// the defaults.
+func (o *GlitterOptions) ReadConfig(filename string) error {
+	if len(filename) == 0 {
+		return nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return o.ReadConfigFrom(f)
+}
+
+// ReadConfigFrom reads weave configuration options from the given stream. Any
+// line that does not start with `%%glitter` is ignored.
+func (o *GlitterOptions) ReadConfigFrom(in io.Reader) error {
+	if o.Config == nil {
+		o.Config = make(map[string]string)
+	}
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		subs := weaveConfigRegex.FindStringSubmatch(strings.TrimSpace(scanner.Text()))
+		if subs != nil {
+			option := strings.TrimSpace(subs[1])
+			value := strings.TrimSpace(subs[2])
+			o.Config[option] = expandNewlines(value)
+		}
+	}
+	return scanner.Err()
+}
+
+// GetConfig returns the value of the configuration option given by name.
+func (o *GlitterOptions) GetConfig(name string) string {
+	return o.Config[name]
+}
+
+// expandNewlines replaces each `$n` in the configuration value v with a
+// newline. Variables whose names start with n, such as `$nextdef`, are left
+// for expandVars.
+func expandNewlines(v string) string {
+	return newlineRegex.ReplaceAllStringFunc(v, func(s string) string {
+		if s == "$n" {
+			return "\n"
+		}
+		return s
+	})
+}
+
+// expandVars replaces the $name and ${name} variables in the configuration
+// template tt with their values in vars. A variable that is not in vars is
+// replaced by its name.
+func expandVars(tt string, vars map[string]string) string {
+	return os.Expand(tt, func(s string) string {
+		if v, ok := vars[s]; ok {
+			return v
+		}
+		return s
+	})
+}
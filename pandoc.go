@@ -0,0 +1,349 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+//=================================================================================
+// Pandoc backend - Pandoc's JSON AST
+//=================================================================================
+
+// pandocAPIVersion is the version of the Pandoc AST that is written.
+var pandocAPIVersion = []int{1, 23, 1}
+
+// pandocElement is a block or inline element of the Pandoc AST.
+type pandocElement struct {
+	T string `json:"t"`
+	C any    `json:"c,omitempty"`
+}
+
+// pandocDocument is the top level of the Pandoc AST.
+type pandocDocument struct {
+	APIVersion []int           `json:"pandoc-api-version"`
+	Meta       map[string]any  `json:"meta"`
+	Blocks     []pandocElement `json:"blocks"`
+}
+
+// pandocAttr returns a Pandoc Attr: an identifier, classes and key-value
+// pairs.
+func pandocAttr(id string, classes []string, kvs ...[2]string) []any {
+	if kvs == nil {
+		kvs = make([][2]string, 0)
+	}
+	return []any{id, classes, kvs}
+}
+
+// pandocStr returns a Str inline.
+func pandocStr(s string) pandocElement {
+	return pandocElement{T: "Str", C: s}
+}
+
+// pandocBackend writes the document as Pandoc's JSON AST, so that pandoc can
+// convert it to any of its output formats. Text becomes paragraphs of words,
+// or of raw inlines if the PandocRawFormat option is set; code chunks become
+// CodeBlocks with the block's anchor as their identifier; and references
+// become Links to the first definition of their block.
+type pandocBackend struct {
+	ctx *RunContext
+	doc pandocDocument
+
+	inCode bool
+	// para holds the inlines of the current paragraph, and lineEmpty is true
+	// if nothing has been added to it on the current line.
+	para      []pandocElement
+	lineEmpty bool
+	// code holds the text of the current code chunk, and refs the references
+	// in it.
+	code strings.Builder
+	refs []*WeaveRef
+	// index holds the items of the index list.
+	index [][]pandocElement
+}
+
+// newPandocBackend creates a Pandoc backend for the given run.
+func newPandocBackend(ctx *RunContext) Backend {
+	return &pandocBackend{ctx: ctx}
+}
+
+// pandocLink returns a link to the first definition of the referenced block,
+// or just its name and id if it is not defined.
+func pandocLink(name string, info *WeaveBlockInfo) pandocElement {
+	if info == nil {
+		return pandocStr(fmt.Sprintf("⟨%s ??⟩", name))
+	}
+	text := pandocStr(fmt.Sprintf("⟨%s %d⟩", name, info.Id()))
+	if len(info.Defs()) == 0 {
+		return text
+	}
+	return pandocElement{T: "Link", C: []any{
+		pandocAttr("", []string{"glitter-ref"}),
+		[]pandocElement{text},
+		[]string{"#" + htmlAnchor(info.Id(), 0), ""},
+	}}
+}
+
+// pandocWords returns the words of s separated by Spaces.
+func pandocWords(s string) []pandocElement {
+	words := make([]pandocElement, 0)
+	for i, word := range strings.Fields(s) {
+		if i > 0 {
+			words = append(words, pandocElement{T: "Space"})
+		}
+		words = append(words, pandocStr(word))
+	}
+	return words
+}
+
+// pandocCode returns a Code inline.
+func pandocCode(code string) pandocElement {
+	return pandocElement{T: "Code", C: []any{pandocAttr("", []string{"go"}), code}}
+}
+
+// pandocLinks returns links to the blocks of refs, separated by commas.
+func pandocLinks(refs []*WeaveRef) []pandocElement {
+	links := make([]pandocElement, 0)
+	for i, ref := range refs {
+		if i > 0 {
+			links = append(links, pandocStr(","), pandocElement{T: "Space"})
+		}
+		links = append(links, pandocLink(ref.Name, ref.Block))
+	}
+	return links
+}
+
+// addBlock appends a block to the document.
+func (b *pandocBackend) addBlock(t string, c any) {
+	b.doc.Blocks = append(b.doc.Blocks, pandocElement{T: t, C: c})
+}
+
+// addInline appends an inline element to the current paragraph.
+func (b *pandocBackend) addInline(e pandocElement) {
+	b.para = append(b.para, e)
+	b.lineEmpty = false
+}
+
+// addSpace appends a Space to the current paragraph, unless it would start a
+// line or follow another space.
+func (b *pandocBackend) addSpace() {
+	if b.lineEmpty || len(b.para) == 0 || b.para[len(b.para)-1].T == "Space" {
+		return
+	}
+	b.addInline(pandocElement{T: "Space"})
+}
+
+// endPara adds the current paragraph, if there is one, to the document.
+func (b *pandocBackend) endPara() {
+	for len(b.para) > 0 && (b.para[len(b.para)-1].T == "SoftBreak" || b.para[len(b.para)-1].T == "Space") {
+		b.para = b.para[:len(b.para)-1]
+	}
+	if len(b.para) > 0 {
+		b.addBlock("Para", b.para)
+	}
+	b.para = make([]pandocElement, 0)
+}
+
+// BeginDocument starts the document. The preamble is meant for the LaTeX
+// format and is not written.
+func (b *pandocBackend) BeginDocument(w io.Writer, doc *WeaveDocument) error {
+	b.doc = pandocDocument{
+		APIVersion: pandocAPIVersion,
+		Meta:       make(map[string]any),
+		Blocks:     make([]pandocElement, 0),
+	}
+	b.para = make([]pandocElement, 0)
+	return nil
+}
+
+// EndDocument writes the document as JSON.
+func (b *pandocBackend) EndDocument(w io.Writer, doc *WeaveDocument) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(b.doc)
+}
+
+// BeginText starts a paragraph.
+func (b *pandocBackend) BeginText(w io.Writer, chunk *TextChunk) error {
+	b.inCode = false
+	return nil
+}
+
+// EndText ends the paragraph.
+func (b *pandocBackend) EndText(w io.Writer, chunk *TextChunk) error {
+	b.endPara()
+	return nil
+}
+
+// BeginCode adds the header of the chunk and starts collecting its code.
+func (b *pandocBackend) BeginCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = true
+	b.code.Reset()
+	b.refs = make([]*WeaveRef, 0)
+	eq := "≡"
+	if code.Series > 0 {
+		eq = "+≡"
+	}
+	header := []pandocElement{pandocStr(fmt.Sprintf("⟨%s %d⟩%s", code.Chunk.Name, code.Id, eq))}
+	b.addBlock("Para", []pandocElement{{T: "Strong", C: header}})
+	return nil
+}
+
+// EndCode adds the CodeBlock and, since links cannot appear inside it, a
+// paragraph that links to the blocks it refers to.
+func (b *pandocBackend) EndCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = false
+	attr := pandocAttr(htmlAnchor(code.Id, code.Series), []string{"go", "glitter"},
+		[2]string{"name", code.Chunk.Name},
+		[2]string{"blockid", strconv.Itoa(code.Id)},
+		[2]string{"blockseries", strconv.Itoa(code.Series)},
+		[2]string{"blocktable", strconv.FormatBool(code.Chunk.Key)},
+	)
+	b.addBlock("CodeBlock", []any{attr, strings.TrimSuffix(b.code.String(), "\n")})
+	if len(b.refs) > 0 {
+		uses := []pandocElement{pandocStr("Uses")}
+		for i, ref := range b.refs {
+			if i > 0 {
+				uses = append(uses, pandocStr(","))
+			}
+			uses = append(uses, pandocElement{T: "Space"}, pandocLink(ref.Name, ref.Block))
+		}
+		b.addBlock("Para", append(uses, pandocStr(".")))
+	}
+	return nil
+}
+
+// BeginLine starts a line.
+func (b *pandocBackend) BeginLine(w io.Writer, pos FilePos) error {
+	b.lineEmpty = true
+	return nil
+}
+
+// EndLine ends a line. In text, a blank line ends the paragraph.
+func (b *pandocBackend) EndLine(w io.Writer) error {
+	switch {
+	case b.inCode:
+		b.code.WriteString("\n")
+	case b.lineEmpty:
+		b.endPara()
+	default:
+		if b.para[len(b.para)-1].T == "Space" {
+			b.para = b.para[:len(b.para)-1]
+		}
+		b.para = append(b.para, pandocElement{T: "SoftBreak"})
+	}
+	return nil
+}
+
+// Text adds s to the code or, in text, adds its words to the paragraph.
+func (b *pandocBackend) Text(w io.Writer, s string) error {
+	if b.inCode {
+		b.code.WriteString(s)
+		return nil
+	}
+	if strings.TrimSpace(s) == "" {
+		if s != "" {
+			b.addSpace()
+		}
+		return nil
+	}
+	if raw := b.ctx.GetConfig("PandocRawFormat"); raw != "" {
+		b.addInline(pandocElement{T: "RawInline", C: []string{raw, s}})
+		return nil
+	}
+	if unicode.IsSpace(rune(s[0])) {
+		b.addSpace()
+	}
+	for i, word := range strings.Fields(s) {
+		if i > 0 {
+			b.addSpace()
+		}
+		b.addInline(pandocStr(word))
+	}
+	if unicode.IsSpace(rune(s[len(s)-1])) {
+		b.addSpace()
+	}
+	return nil
+}
+
+// CodeRef adds a link to the referenced block in text. In code, where links
+// are not possible, it adds the name and id of the block.
+func (b *pandocBackend) CodeRef(w io.Writer, ref *WeaveRef) error {
+	if b.inCode {
+		b.refs = append(b.refs, ref)
+		fmt.Fprintf(&b.code, "⟨%s %d⟩", ref.Name, ref.Id)
+		return nil
+	}
+	b.addInline(pandocLink(ref.Name, ref.Block))
+	return nil
+}
+
+// InlineCode adds a Code inline.
+func (b *pandocBackend) InlineCode(w io.Writer, code string) error {
+	b.addInline(pandocCode(code))
+	return nil
+}
+
+// BlockAnnotations adds a paragraph with the names the chunk declares and
+// uses, with a link to the block that declares each use.
+func (b *pandocBackend) BlockAnnotations(w io.Writer, ann *WeaveAnnotations) error {
+	para := make([]pandocElement, 0)
+	if len(ann.Defines) > 0 {
+		para = append(para, pandocWords(b.ctx.GetConfig("IndexDefines"))...)
+		for i, name := range ann.Defines {
+			if i > 0 {
+				para = append(para, pandocStr(","))
+			}
+			para = append(para, pandocElement{T: "Space"}, pandocCode(name))
+		}
+	}
+	if len(ann.Uses) > 0 {
+		if len(para) > 0 {
+			para = append(para, pandocElement{T: "Space"})
+		}
+		para = append(para, pandocWords(b.ctx.GetConfig("IndexUses"))...)
+		for i, use := range ann.Uses {
+			if i > 0 {
+				para = append(para, pandocStr(","))
+			}
+			para = append(para, pandocElement{T: "Space"}, pandocCode(use.Name))
+			if use.Decl != nil {
+				para = append(para, pandocElement{T: "Space"}, pandocLink(use.Decl.Name, use.Decl.Block))
+			}
+		}
+	}
+	b.addBlock("Para", para)
+	return nil
+}
+
+// BeginIndex adds a level 2 Header with IndexTitle and starts the list.
+func (b *pandocBackend) BeginIndex(w io.Writer) error {
+	b.addBlock("Header", []any{2, pandocAttr("glitter-index", []string{}), pandocWords(b.ctx.GetConfig("IndexTitle"))})
+	b.index = make([][]pandocElement, 0)
+	return nil
+}
+
+// IndexEntry adds an item with the name and links to the blocks that declare
+// and use it.
+func (b *pandocBackend) IndexEntry(w io.Writer, entry *WeaveIndexEntry) error {
+	item := []pandocElement{pandocCode(entry.Name), pandocStr(":"), {T: "Space"}}
+	item = append(item, pandocLinks(entry.DefinedIn)...)
+	if len(entry.UsedIn) > 0 {
+		item = append(item, pandocStr(";"), pandocElement{T: "Space"})
+		item = append(item, pandocWords(b.ctx.GetConfig("IndexUsedIn"))...)
+		item = append(item, pandocElement{T: "Space"})
+		item = append(item, pandocLinks(entry.UsedIn)...)
+	}
+	b.index = append(b.index, []pandocElement{{T: "Plain", C: item}})
+	return nil
+}
+
+// EndIndex adds the list.
+func (b *pandocBackend) EndIndex(w io.Writer) error {
+	b.addBlock("BulletList", b.index)
+	return nil
+}
@@ -0,0 +1,96 @@
+package glitter
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWeavePandoc(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	if err := ctx.SetFormat("pandoc"); err != nil {
+		t.Fatal(err)
+	}
+	src := `@: See <<Block two>>,
+and [[x]].
+
+New paragraph.
+<<Block one>>=
+    <<Block two>>
+<<Block two>>=
+    x := 1
+`
+	var out strings.Builder
+	in := strings.NewReader(src)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Blocks []json.RawMessage `json:"blocks"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &doc); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`{"t":"Para","c":[{"t":"Str","c":"See"},{"t":"Space"},` +
+			`{"t":"Link","c":[["",["glitter-ref"],[]],[{"t":"Str","c":"⟨Block two 1⟩"}],["#glitter-1-0",""]]},` +
+			`{"t":"Str","c":","},{"t":"SoftBreak"},{"t":"Str","c":"and"},{"t":"Space"},` +
+			`{"t":"Code","c":[["",["go"],[]],"x"]},{"t":"Str","c":"."}]}`,
+		`{"t":"Para","c":[{"t":"Str","c":"New"},{"t":"Space"},{"t":"Str","c":"paragraph."}]}`,
+		`{"t":"Para","c":[{"t":"Strong","c":[{"t":"Str","c":"⟨Block one 2⟩≡"}]}]}`,
+		`{"t":"CodeBlock","c":[["glitter-2-0",["go","glitter"],[["name","Block one"],["blockid","2"],["blockseries","0"],["blocktable","false"]]],"⟨Block two 1⟩"]}`,
+		`{"t":"Para","c":[{"t":"Str","c":"Uses"},{"t":"Space"},` +
+			`{"t":"Link","c":[["",["glitter-ref"],[]],[{"t":"Str","c":"⟨Block two 1⟩"}],["#glitter-1-0",""]]},{"t":"Str","c":"."}]}`,
+		`{"t":"Para","c":[{"t":"Strong","c":[{"t":"Str","c":"⟨Block two 1⟩≡"}]}]}`,
+		`{"t":"CodeBlock","c":[["glitter-1-0",["go","glitter"],[["name","Block two"],["blockid","1"],["blockseries","0"],["blocktable","false"]]],"x := 1"]}`,
+	}
+	if len(doc.Blocks) != len(want) {
+		t.Fatalf("got %d blocks, want %d:\n%s", len(doc.Blocks), len(want), out.String())
+	}
+	for i, w := range want {
+		if string(doc.Blocks[i]) != w {
+			t.Errorf("block %d =\n%s\nwant\n%s", i, doc.Blocks[i], w)
+		}
+	}
+}
+
+func TestWeavePandocGoIndex(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	ctx.Config["WeaveIndex"] = "true"
+	if err := ctx.SetFormat("pandoc"); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	in := strings.NewReader(goIndexTestSource)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Blocks []json.RawMessage `json:"blocks"`
+	}
+	if err := json.Unmarshal([]byte(out.String()), &doc); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		`{"t":"Header","c":[2,["glitter-index",[],[]],[{"t":"Str","c":"Index"}]]}`,
+		`{"t":"BulletList","c":[` +
+			`[{"t":"Plain","c":[{"t":"Code","c":[["",["go"],[]],"greet"]},{"t":"Str","c":":"},{"t":"Space"},` +
+			`{"t":"Link","c":[["",["glitter-ref"],[]],[{"t":"Str","c":"⟨Greeting 2⟩"}],["#glitter-2-0",""]]},` +
+			`{"t":"Str","c":";"},{"t":"Space"},{"t":"Str","c":"used"},{"t":"Space"},{"t":"Str","c":"in"},{"t":"Space"},` +
+			`{"t":"Link","c":[["",["glitter-ref"],[]],[{"t":"Str","c":"⟨* \"prog.go\" 1⟩"}],["#glitter-1-0",""]]}]}],` +
+			`[{"t":"Plain","c":[{"t":"Code","c":[["",["go"],[]],"greeting"]},{"t":"Str","c":":"},{"t":"Space"},` +
+			`{"t":"Link","c":[["",["glitter-ref"],[]],[{"t":"Str","c":"⟨Greeting 2⟩"}],["#glitter-2-0",""]]},` +
+			`{"t":"Str","c":";"},{"t":"Space"},{"t":"Str","c":"used"},{"t":"Space"},{"t":"Str","c":"in"},{"t":"Space"},` +
+			`{"t":"Link","c":[["",["glitter-ref"],[]],[{"t":"Str","c":"⟨* \"prog.go\" 1⟩"}],["#glitter-1-0",""]]}]}],` +
+			`[{"t":"Plain","c":[{"t":"Code","c":[["",["go"],[]],"main"]},{"t":"Str","c":":"},{"t":"Space"},` +
+			`{"t":"Link","c":[["",["glitter-ref"],[]],[{"t":"Str","c":"⟨* \"prog.go\" 1⟩"}],["#glitter-1-0",""]]}]}]]}`,
+	}
+	if len(doc.Blocks) < len(want) {
+		t.Fatalf("got %d blocks:\n%s", len(doc.Blocks), out.String())
+	}
+	for i, w := range want {
+		if got := string(doc.Blocks[len(doc.Blocks)-len(want)+i]); got != w {
+			t.Errorf("block %d =\n%s\nwant\n%s", len(doc.Blocks)-len(want)+i, got, w)
+		}
+	}
+}
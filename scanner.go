@@ -0,0 +1,386 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+//=================================================================================
+// Source Lines and Blocks
+//=================================================================================
+
+// LineType is the type of the constants that represent the type of a line.
+type LineType int8
+
+// These are the types of lines we can observe
+const (
+	TextStartLine LineType = iota
+	CodeStartLine
+	GlitterLine
+	OtherLine
+)
+
+// FilePos represents a position in a file
+type FilePos struct {
+	filename string
+	lineno   int
+}
+
+// NewFilePos returns a FilePos for the given file and line number.
+func NewFilePos(filename string, lineno int) FilePos {
+	return FilePos{filename: filename, lineno: lineno}
+}
+
+// Filename returns the filename of the position.
+func (f *FilePos) Filename() string {
+	return f.filename
+}
+
+// LineNo returns the line number of the file position.
+func (f *FilePos) LineNo() int {
+	return f.lineno
+}
+
+// MarshalJSON writes the position as an object with the file and line.
+func (f FilePos) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		File string `json:"file"`
+		Line int    `json:"line"`
+	}{f.filename, f.lineno})
+}
+
+// UnmarshalJSON reads a position written by MarshalJSON.
+func (f *FilePos) UnmarshalJSON(data []byte) error {
+	var pos struct {
+		File string `json:"file"`
+		Line int    `json:"line"`
+	}
+	if err := json.Unmarshal(data, &pos); err != nil {
+		return err
+	}
+	f.filename, f.lineno = pos.File, pos.Line
+	return nil
+}
+
+// SourceLine represents a line in the source files
+type SourceLine struct {
+	pos  FilePos
+	line string
+
+	// col is the byte offset in the source line where line starts. It is
+	// not 0 once the line has been deindented.
+	col int
+
+	// depth is the include depth of the file the line came from (1 = a file
+	// given to the scanner) and file is a number that is different for every
+	// file the scanner opens, even if it opens the same file twice.
+	depth int
+	file  int
+
+	// include is the file named by an @include line, and empty for every
+	// other kind of line.
+	include string
+}
+
+// Line returns the string for the line.
+func (s *SourceLine) Line() string {
+	return s.line
+}
+
+// Pos returns the position of the line.
+func (s *SourceLine) Pos() FilePos {
+	return s.pos
+}
+
+// Depth returns the include depth of the line (1 = top level).
+func (s *SourceLine) Depth() int {
+	return s.depth
+}
+
+// Include returns the file named by the line and true if this is an @include
+// line.
+func (s *SourceLine) Include() (string, bool) {
+	return s.include, s.include != ""
+}
+
+// Block type represents a list of source code lines.
+type Block struct {
+	lines []SourceLine
+
+	// starts holds the indices of the lines that begin the chunks of the
+	// block after the first, which tangle marks with a line directive.
+	starts []int
+}
+
+// AppendLine adds a SourceLine to the block.
+func (b *Block) AppendLine(ll SourceLine) {
+	b.lines = append(b.lines, ll)
+}
+
+// appendBlocks appends b2 to b1 and returns the new block.
+func appendBlocks(b1, b2 Block) Block {
+	starts := slices.Clone(b1.starts)
+	for _, i := range b2.starts {
+		starts = append(starts, i+len(b1.lines))
+	}
+	return Block{
+		lines:  append(b1.lines, b2.lines...),
+		starts: starts,
+	}
+}
+
+var (
+	// includeRegex matches an include line
+	includeRegex = regexp.MustCompile(`^\s*@include\s+"(.+)"\s*$`)
+
+	// textStartRegex denotes how a line should begin to start a text block.
+	// The : is in () so that we have a group, which is required by
+	// lineMatchesWithArg.
+	textStartRegex = regexp.MustCompile(`^\s*@(:+)`)
+	codeStartRegex = regexp.MustCompile(`^\s*<<(.+)>>=\s*$`)
+	escapeRegex    = regexp.MustCompile(`#+`)
+	spaceRegexp    = regexp.MustCompile(`\s+`)
+	topLevelRegex  = regexp.MustCompile(`^\*\s*(".*")?\s*(\d+)?\s*$`)
+	topLevelStart  = regexp.MustCompile(`^\s*\*`)
+	glitterRegex   = regexp.MustCompile(`^\s*@glitter(\s.*)?$`)
+	emptyLineRegex = regexp.MustCompile(`^\s*$`)
+
+	// codeRefRegex matches a reference to a code block. The +? operator means
+	// match more than one, prefer fewer. This is neded because we may have
+	// more than one code ref on a single line. Code refs cannot have unescaped
+	// >> in their label.
+	codeRefRegex = regexp.MustCompile(`<<(.+?)>>`)
+
+	// textSpanRegex matches either a code reference or [[ .. ]] inline code.
+	textSpanRegex = regexp.MustCompile(`<<(.+?)>>|\[\[(.+?)\]\]`)
+)
+
+//=================================================================================
+// GlitterScanner -- read a collection of Glitter files
+//=================================================================================
+
+// GlitterScanner enables recursively scanning through glitter source files,
+// handling @include commands as needed.
+type GlitterScanner struct {
+	filenames      []string
+	in             io.Reader
+	inName         string
+	stack          []FilePos
+	fileNums       []int
+	filesOpened    int
+	processedFiles StringSet
+	err            error
+	ctx            *RunContext
+}
+
+// errStopScanning is used internally to unwind the reader when the consumer
+// of Lines stops early.
+var errStopScanning = errors.New("scanning stopped")
+
+// NewGlitterScanner creates a GlitterScanner that will read through the given
+// files.
+func NewGlitterScanner(filenames []string, ctx *RunContext) *GlitterScanner {
+	scanner := GlitterScanner{
+		filenames:      filenames,
+		stack:          make([]FilePos, 0),
+		processedFiles: NewStringSet(),
+		ctx:            ctx,
+	}
+	return &scanner
+}
+
+// NewGlitterScannerFromReader creates a GlitterScanner that reads the glitter
+// source from in, reporting positions as if it were read from the file name.
+// Any @include lines in the stream are read from the run's Sources.
+func NewGlitterScannerFromReader(name string, in io.Reader, ctx *RunContext) *GlitterScanner {
+	scanner := NewGlitterScanner(nil, ctx)
+	scanner.in = in
+	scanner.inName = name
+	return scanner
+}
+
+// Lines returns an iterator over the successive *SourceLine of the files,
+// with each @include line followed by the lines of the file it includes. If
+// reading fails, the iterator yields the error, together with the line that
+// caused it (or nil if no line did), and stops. Every file is closed by the
+// time the iteration ends, including when the consumer stops early. A
+// GlitterScanner can only be iterated once.
+func (g *GlitterScanner) Lines() iter.Seq2[*SourceLine, error] {
+	return func(yield func(*SourceLine, error) bool) {
+		var errLine *SourceLine
+		err := g.readAll(yield, &errLine)
+		if err == errStopScanning {
+			return
+		}
+		if err != nil {
+			g.err = err
+			yield(errLine, err)
+		}
+	}
+}
+
+// readAll reads the stream (if any) and then each of the files in turn.
+func (g *GlitterScanner) readAll(yield func(*SourceLine, error) bool, errLine **SourceLine) error {
+	if g.in != nil {
+		g.pushFile(g.inName)
+		err := g.readGlitterStream(g.in, yield, errLine)
+		g.popFile()
+		if err != nil {
+			return err
+		}
+	}
+	for _, f := range g.filenames {
+		if err := g.readGlitterSourceFile(f, yield, errLine); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (g *GlitterScanner) Err() error {
+	return g.err
+}
+
+// CurrentFilePos returns the FilePos object for the file currently being read.
+func (g *GlitterScanner) CurrentFilePos() *FilePos {
+	return &g.stack[len(g.stack)-1]
+}
+
+// Depth returns the current include depth (1= top level)
+func (g *GlitterScanner) Depth() int {
+	return len(g.stack)
+}
+
+// pushFile adds a file to the reading stack.
+func (g *GlitterScanner) pushFile(filename string) {
+	g.filesOpened++
+	g.stack = append(g.stack, FilePos{filename: filename, lineno: 0})
+	g.fileNums = append(g.fileNums, g.filesOpened)
+}
+
+// popFile removes a file from the reading stack.
+func (g *GlitterScanner) popFile() {
+	g.stack = g.stack[:len(g.stack)-1]
+	g.fileNums = g.fileNums[:len(g.fileNums)-1]
+}
+
+// readGlitterSourceFile reads a file given its filename.
+func (g *GlitterScanner) readGlitterSourceFile(
+	filename string,
+	yield func(*SourceLine, error) bool,
+	errLine **SourceLine) error {
+
+	// do not process a file we have already processed.
+	filename = path.Clean(filename)
+	if g.ctx.DisallowMultipleIncludes && g.processedFiles.Contains(filename) {
+		return nil
+	}
+	g.ctx.Info(1, "Processing file `%s`", filename)
+	in, err := g.ctx.Sources.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// remember that we processed this file.
+	g.processedFiles.Insert(filename)
+	// push file info onto stack
+	g.pushFile(filename)
+	// recursively read it
+	err = g.readGlitterStream(in, yield, errLine)
+	// pop file info from stack
+	g.popFile()
+	return err
+}
+
+// readGlitterStream reads a stream with source lines in it, passing each line
+// to yield.
+func (g *GlitterScanner) readGlitterStream(
+	in io.Reader,
+	yield func(*SourceLine, error) bool,
+	errLine **SourceLine) error {
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := scanner.Text()
+		g.CurrentFilePos().lineno++
+		l := g.newSourceLine(line)
+
+		// if this is an include line, pass it on and then recurse
+		if include, filename := lineMatchesWithArg(line, includeRegex); include {
+			if len(g.stack) >= MAX_INCLUDE_DEPTH {
+				*errLine = l
+				return ErrorWithFile(l.pos, "%v", errorRecursionTooDeep)
+			}
+			l.include = filename
+			if !yield(l, nil) {
+				return errStopScanning
+			}
+			if err := g.readGlitterSourceFile(filename, yield, errLine); err != nil {
+				if *errLine == nil && err != errStopScanning {
+					*errLine = l
+					err = fmt.Errorf("%s:%d: %w", l.pos.filename, l.pos.lineno, err)
+				}
+				return err
+			}
+		} else if !yield(l, nil) {
+			return errStopScanning
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		pos := *g.CurrentFilePos()
+		return fmt.Errorf("%s:%d: %w", pos.filename, pos.lineno+1, err)
+	}
+	return nil
+}
+
+// newSourceLine creates a new source line from the current file (top of the
+// stack) and the given string.
+func (g *GlitterScanner) newSourceLine(line string) *SourceLine {
+	return &SourceLine{
+		pos:   *g.CurrentFilePos(),
+		line:  line,
+		depth: len(g.stack),
+		file:  g.fileNums[len(g.fileNums)-1],
+	}
+}
+
+// lineMatchesWithArg returns ok == true, and argument equal to the first
+// captured group if the line matches the given regular expression, which must
+// include a single () capture group. Otherwise it returns false and ""
+func lineMatchesWithArg(line string, re *regexp.Regexp) (bool, string) {
+	subs := re.FindStringSubmatch(strings.TrimSpace(line))
+	if subs == nil {
+		return false, ""
+	}
+	return true, subs[1]
+}
+
+// computeLineType figures out what type the current line is. Most lines are
+// code or text, and do not start with @ or <, so those are dealt with without
+// running the regexes.
+func computeLineType(line string) (LineType, string) {
+	trimmed := strings.TrimLeftFunc(line, unicode.IsSpace)
+	if trimmed == "" || (trimmed[0] != '@' && trimmed[0] != '<') {
+		return OtherLine, ""
+	}
+	if m, arg := lineMatchesWithArg(line, textStartRegex); m {
+		return TextStartLine, arg
+	} else if m, arg := lineMatchesWithArg(line, codeStartRegex); m {
+		return CodeStartLine, arg
+	} else if m, arg := lineMatchesWithArg(line, glitterRegex); m {
+		return GlitterLine, arg
+	} else {
+		return OtherLine, ""
+	}
+}
@@ -0,0 +1,111 @@
+package glitter
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// countingFS counts the files that are open.
+type countingFS struct {
+	fs.FS
+	open int
+}
+
+type countingFile struct {
+	fs.File
+	fsys *countingFS
+}
+
+func (f *countingFile) Close() error {
+	f.fsys.open--
+	return f.File.Close()
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	f, err := c.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	c.open++
+	return &countingFile{File: f, fsys: c}, nil
+}
+
+func TestScannerEarlyStopClosesFiles(t *testing.T) {
+	src := &countingFS{FS: fstest.MapFS{
+		"a.gw": {Data: []byte("one\n@include \"b.gw\"\nfour\n")},
+		"b.gw": {Data: []byte("two\nthree\n")},
+	}}
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Sources = src
+
+	for l, err := range NewGlitterScanner([]string{"a.gw"}, ctx).Lines() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Line() == "two" {
+			if src.open != 2 {
+				t.Fatalf("%d files open while reading b.gw, want 2", src.open)
+			}
+			break
+		}
+	}
+	if src.open != 0 {
+		t.Errorf("%d files still open after stopping early", src.open)
+	}
+}
+
+func TestScannerErrorHasLine(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Sources = fstest.MapFS{
+		"a.gw": {Data: []byte("one\n@include \"missing.gw\"\nthree\n")},
+	}
+	lines := 0
+	for l, err := range NewGlitterScanner([]string{"a.gw"}, ctx).Lines() {
+		if err == nil {
+			lines++
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("err = %v, want a fs.ErrNotExist", err)
+		}
+		if l == nil || l.pos.LineNo() != 2 {
+			t.Fatalf("error line = %+v, want the @include on line 2", l)
+		}
+	}
+	if lines != 2 {
+		t.Errorf("read %d lines before the error, want 2", lines)
+	}
+}
+
+func TestComputeLineType(t *testing.T) {
+	tests := []struct {
+		line string
+		typ  LineType
+		arg  string
+	}{
+		{"    x := 1", OtherLine, ""},
+		{"", OtherLine, ""},
+		{"  @:: Text", TextStartLine, "::"},
+		{"<<Name>>=", CodeStartLine, "Name"},
+		{"\t<<Name>>= ", CodeStartLine, "Name"},
+		{"<<Name>>", OtherLine, ""},
+		{"@glitter hide", GlitterLine, " hide"},
+		{"@glitterati", OtherLine, ""},
+	}
+	for _, tt := range tests {
+		if typ, arg := computeLineType(tt.line); typ != tt.typ || arg != tt.arg {
+			t.Errorf("computeLineType(%q) = %v, %q, want %v, %q", tt.line, typ, arg, tt.typ, tt.arg)
+		}
+	}
+}
+
+func BenchmarkComputeLineType(b *testing.B) {
+	lines := []string{"    x := f(y)", "@: Some text.", "<<Block>>=", "        return nil", ""}
+	for range b.N {
+		for _, l := range lines {
+			computeLineType(l)
+		}
+	}
+}
@@ -0,0 +1,386 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+//=================================================================================
+// Sites - a woven document split over a set of linked HTML pages
+//=================================================================================
+
+// siteStyle and siteScript are the style sheet and the search script shared
+// by the pages of a site. They are written to the site as glitter.css and
+// glitter.js, so the site works without a network connection.
+//
+//go:embed glittersite.css
+var siteStyle string
+
+//go:embed glittersite.js
+var siteScript string
+
+// pageNameRegex matches the runs of characters that are replaced to make a
+// page's filename from the name of its chapter.
+var pageNameRegex = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// sitePage is a page of a site, which holds the visible chunks of a chapter.
+type sitePage struct {
+	title  string
+	file   string
+	chunks []Chunk
+}
+
+// siteSearchEntry is an entry of the search index: a code chunk, or the text
+// chunks of a page.
+type siteSearchEntry struct {
+	Title  string `json:"title"`
+	Page   string `json:"page"`
+	Anchor string `json:"anchor,omitempty"`
+	Text   string `json:"text"`
+}
+
+// siteWriter writes the pages of a site to a directory of the run's Outputs.
+type siteWriter struct {
+	ctx   *RunContext
+	dir   string
+	wd    *WeaveDocument
+	pages []*sitePage
+
+	// pageOf gives the page that holds the element with each anchor.
+	pageOf map[string]string
+}
+
+// siteBackend writes a page of a site. It is the HTML backend, except that
+// links go to the page that holds each chunk and the page has the site's
+// navigation sidebar.
+type siteBackend struct {
+	*htmlBackend
+	site *siteWriter
+	page *sitePage
+}
+
+// Site reads the given files and writes them, as a set of linked HTML pages,
+// to directory dir of the run's Outputs.
+func Site(filenames []string, dir string, ctx *RunContext) error {
+	if ctx.Mode != ModeWeave {
+		return fmt.Errorf("cannot weave in a %s run", ctx.Mode)
+	}
+	doc, err := Parse(NewGlitterScanner(filenames, ctx))
+	if err != nil {
+		return err
+	}
+	return NewWeaver(ctx).WriteSite(doc, dir)
+}
+
+// WriteSite writes the parsed document to directory dir of the run's Outputs
+// as a static HTML site. Each file given to the scanner, and each file one of
+// them includes, is a chapter with a page of its own, and index.html lists
+// the chapters, every code block and the index of Go names. References link across pages, and the
+// pages share a navigation sidebar with a search box that uses the index in
+// search.json (also written as search.js, so that it can be loaded from the
+// filesystem).
+func (wv *Weaver) WriteSite(doc *Document, dir string) error {
+	if wv.ctx.Mode != ModeWeave {
+		return fmt.Errorf("cannot weave in a %s run", wv.ctx.Mode)
+	}
+	s := &siteWriter{
+		ctx:    wv.ctx,
+		dir:    dir,
+		wd:     newWeaveDocument(wv.ctx, doc),
+		pageOf: make(map[string]string),
+	}
+	s.makePages()
+
+	for _, p := range s.pages {
+		b := &siteBackend{
+			htmlBackend: &htmlBackend{ctx: wv.ctx},
+			site:        s,
+			page:        p,
+		}
+		b.href = func(id, series int) string {
+			return s.link(p, id, series)
+		}
+		err := s.writeFile(p.file, func(w *bufio.Writer) error {
+			r := &weaveRun{b: b, w: w, wd: s.wd, ctx: wv.ctx}
+			return r.weaveChunks(p.chunks, false)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.writeFile("index.html", s.writeIndex); err != nil {
+		return err
+	}
+	for _, asset := range []struct{ name, data string }{
+		{"glitter.css", siteStyle},
+		{"glitter.js", siteScript},
+	} {
+		err := s.writeFile(asset.name, func(w *bufio.Writer) error {
+			_, err := w.WriteString(asset.data)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := s.writeSearchIndex(); err != nil {
+		return err
+	}
+	wv.printUndefinedBlocks(s.wd)
+	return nil
+}
+
+// makePages splits the visible chunks of the document into pages, one for
+// each chapter in the order the chapters are first read, and records which
+// page holds each code chunk.
+func (s *siteWriter) makePages() {
+	byChapter := make(map[string]*sitePage)
+	used := map[string]bool{"index": true, "search": true, "glitter": true}
+	for _, c := range s.wd.Doc.Chunks {
+		var chapter string
+		switch c := c.(type) {
+		case *TextChunk:
+			if c.Hidden {
+				continue
+			}
+			chapter = c.Chapter
+		case *CodeChunk:
+			if c.Hidden {
+				continue
+			}
+			chapter = c.Chapter
+		}
+		p, ok := byChapter[chapter]
+		if !ok {
+			p = &sitePage{title: chapter, file: pageFilename(chapter, used)}
+			byChapter[chapter] = p
+			s.pages = append(s.pages, p)
+		}
+		p.chunks = append(p.chunks, c)
+		if code, ok := c.(*CodeChunk); ok {
+			info := s.wd.Block(code.Canonical)
+			s.pageOf[htmlAnchor(info.Id(), slices.Index(info.Defs(), code))] = p.file
+		}
+	}
+}
+
+// pageFilename returns the name of the page of a chapter: the name of the
+// chapter's file, without its extension and with the characters that are not
+// safe in a URL replaced. Names in used are avoided, and the name returned is
+// added to used.
+func pageFilename(chapter string, used map[string]bool) string {
+	name := strings.TrimSuffix(path.Clean(chapter), GLITTER_EXT)
+	name = strings.Trim(pageNameRegex.ReplaceAllString(name, "_"), "_")
+	if name == "" {
+		name = "page"
+	}
+	base := name
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	used[name] = true
+	return name + ".html"
+}
+
+// link returns the URL, from page from, of chunk number series of the block
+// with the given id.
+func (s *siteWriter) link(from *sitePage, id, series int) string {
+	anchor := htmlAnchor(id, series)
+	if page, ok := s.pageOf[anchor]; ok && (from == nil || page != from.file) {
+		return page + "#" + anchor
+	}
+	return "#" + anchor
+}
+
+// writeFile creates the named file in the site's directory and writes its
+// contents with write.
+func (s *siteWriter) writeFile(name string, write func(w *bufio.Writer) error) error {
+	s.ctx.Info(1, "Writing to `%s`", path.Join(s.dir, name))
+	f, err := s.ctx.Outputs.Create(path.Join(s.dir, name))
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeHead writes the head of a page with the given title, and its sidebar.
+// current is the page being written, or nil for the index.
+func (s *siteWriter) writeHead(w io.Writer, title string, current *sitePage) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n"+
+		"<title>%s</title>\n<link rel=\"stylesheet\" href=\"glitter.css\">\n"+
+		"<script src=\"search.js\"></script>\n<script src=\"glitter.js\"></script>\n</head>\n<body>\n",
+		html.EscapeString(title))
+	sb.WriteString("<nav class=\"glitter-sidebar\">\n")
+	class := ""
+	if current == nil {
+		class = ` class="glitter-current"`
+	}
+	fmt.Fprintf(&sb, "<p><a%s href=\"index.html\">Contents</a></p>\n", class)
+	sb.WriteString("<input id=\"glitter-search\" type=\"search\" placeholder=\"Search\">\n" +
+		"<ul id=\"glitter-search-results\" class=\"glitter-search-results\"></ul>\n<ul>\n")
+	for _, p := range s.pages {
+		class := ""
+		if p == current {
+			class = ` class="glitter-current"`
+		}
+		fmt.Fprintf(&sb, "<li><a%s href=\"%s\">%s</a></li>\n", class, p.file, html.EscapeString(p.title))
+	}
+	sb.WriteString("</ul>\n</nav>\n<main>\n")
+	fmt.Fprintf(&sb, "<h1>%s</h1>\n", html.EscapeString(title))
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeIndex writes the index page: the list of chapters, the key blocks, a
+// table of every code block with links to its definitions and to the blocks
+// that use it, and the index of Go names. The Go index is written here, and
+// not on the pages, so that it appears once.
+func (s *siteWriter) writeIndex(w *bufio.Writer) error {
+	if err := s.writeHead(w, "Contents", nil); err != nil {
+		return err
+	}
+	var sb strings.Builder
+	sb.WriteString("<h2>Chapters</h2>\n<ul>\n")
+	for _, p := range s.pages {
+		fmt.Fprintf(&sb, "<li><a href=\"%s\">%s</a></li>\n", p.file, html.EscapeString(p.title))
+	}
+	sb.WriteString("</ul>\n")
+
+	keys := make([]string, 0)
+	for _, c := range s.wd.Doc.CodeChunks() {
+		if c.Key && !c.Hidden {
+			info := s.wd.Block(c.Canonical)
+			keys = append(keys, fmt.Sprintf("<li><a href=\"%s\">%s</a></li>\n",
+				s.link(nil, info.Id(), slices.Index(info.Defs(), c)), html.EscapeString(c.Name)))
+		}
+	}
+	if len(keys) > 0 {
+		sb.WriteString("<h2>Key Blocks</h2>\n<ul>\n" + strings.Join(keys, "") + "</ul>\n")
+	}
+
+	blocks := slices.Clone(s.wd.Blocks())
+	slices.SortStableFunc(blocks, func(a, b *WeaveBlockInfo) int {
+		return strings.Compare(canonicalCodeName(a.Name()), canonicalCodeName(b.Name()))
+	})
+	sb.WriteString("<h2>Code Blocks</h2>\n<table class=\"glitter-block-index\">\n")
+	for _, info := range blocks {
+		defs := make([]string, 0, len(info.Defs()))
+		for i := range info.Defs() {
+			defs = append(defs, fmt.Sprintf(`<a href="%s">%d</a>`, s.link(nil, info.Id(), i), i+1))
+		}
+		used := make([]string, 0)
+		for _, id := range info.UsedIn() {
+			used = append(used, fmt.Sprintf(`<a href="%s" title="%s">%d</a>`,
+				s.link(nil, id, 0), html.EscapeString(s.wd.BlockById(id).Name()), id))
+		}
+		name := html.EscapeString(info.Name())
+		if len(defs) == 0 {
+			name = `<span class="glitter-undefined">` + name + `</span>`
+		} else {
+			name = fmt.Sprintf(`<a href="%s">%s</a>`, s.link(nil, info.Id(), 0), name)
+		}
+		fmt.Fprintf(&sb, "<tr><td>⟨%s <span class=\"glitter-id\">%d</span>⟩</td><td>defined %s</td><td>%s</td></tr>\n",
+			name, info.Id(), strings.Join(defs, ", "), strings.Join(used, ", "))
+	}
+	sb.WriteString("</table>\n")
+	if _, err := w.WriteString(sb.String()); err != nil {
+		return err
+	}
+
+	b := &htmlBackend{ctx: s.ctx}
+	b.begin(s.wd)
+	b.href = func(id, series int) string {
+		return s.link(nil, id, series)
+	}
+	r := &weaveRun{b: b, w: w, wd: s.wd, ctx: s.ctx}
+	if r.indexing() {
+		if err := r.weaveIndex(); err != nil {
+			return err
+		}
+	}
+	_, err := w.WriteString("</main>\n</body>\n</html>\n")
+	return err
+}
+
+// writeSearchIndex writes search.json, which has an entry for every visible
+// code chunk and one for the text of each page, and search.js, which sets
+// glitterSearchIndex to the same entries.
+func (s *siteWriter) writeSearchIndex() error {
+	entries := make([]siteSearchEntry, 0)
+	for _, p := range s.pages {
+		text := make([]string, 0)
+		for _, c := range p.chunks {
+			switch c := c.(type) {
+			case *TextChunk:
+				text = append(text, visibleText(c.Lines)...)
+			case *CodeChunk:
+				info := s.wd.Block(c.Canonical)
+				entries = append(entries, siteSearchEntry{
+					Title:  c.Name,
+					Page:   p.file,
+					Anchor: htmlAnchor(info.Id(), slices.Index(info.Defs(), c)),
+					Text:   strings.Join(visibleText(c.Lines), "\n"),
+				})
+			}
+		}
+		entries = append(entries, siteSearchEntry{Title: p.title, Page: p.file, Text: strings.Join(text, "\n")})
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	err = s.writeFile("search.json", func(w *bufio.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.writeFile("search.js", func(w *bufio.Writer) error {
+		return writeStrings(w, "var glitterSearchIndex = ", string(data), ";\n")
+	})
+}
+
+// visibleText returns the visible lines, with their `#` escapes replaced.
+func visibleText(lines []ChunkLine) []string {
+	out := make([]string, 0, len(lines))
+	for _, l := range lines {
+		if !l.Hidden {
+			out = append(out, replaceNoOpChars(l.line))
+		}
+	}
+	return out
+}
+
+// BeginDocument writes the head of the page and its sidebar.
+func (b *siteBackend) BeginDocument(w io.Writer, doc *WeaveDocument) error {
+	b.begin(doc)
+	return b.site.writeHead(w, b.page.title, b.page)
+}
+
+// EndDocument writes the list of the page's key blocks and closes the page.
+func (b *siteBackend) EndDocument(w io.Writer, doc *WeaveDocument) error {
+	var sb strings.Builder
+	b.writeKeyBlocks(&sb)
+	sb.WriteString("</main>\n</body>\n</html>\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
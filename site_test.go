@@ -0,0 +1,94 @@
+package glitter
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestWriteSite(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	ctx.Config["WeaveIndex"] = "true"
+	ctx.Sources = fstest.MapFS{
+		"book.gw": {Data: []byte(`@: The book.
+@include "ch/one.gw"
+@include "two.gw"
+`)},
+		"ch/one.gw": {Data: []byte(`@:: Chapter one uses <<Helper>>.
+<<* "prog.go">>=
+    package main
+    <<Helper>>
+`)},
+		"two.gw": {Data: []byte(`@: Chapter two.
+<<Helper>>=
+    func helper() {}
+`)},
+	}
+	out := NewMemFS()
+	ctx.Outputs = out
+	if err := Site([]string{"book.gw"}, "site", ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"site/book.html", "site/ch_one.html", "site/glitter.css", "site/glitter.js",
+		"site/index.html", "site/search.js", "site/search.json", "site/two.html"}
+	if !slices.Equal(out.Names(), want) {
+		t.Fatalf("outputs = %v, want %v", out.Names(), want)
+	}
+
+	read := func(name string) string {
+		data, err := out.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	one := read("site/ch_one.html")
+	for _, want := range []string{
+		`<li><a class="glitter-current" href="ch_one.html">ch/one.gw</a></li>`,
+		`<a class="glitter-ref" href="two.html#glitter-1-0">⟨Helper <span class="glitter-ref-id">1</span>⟩</a>`,
+		`<div class="glitter-code glitter-key" id="glitter-2-0">`,
+	} {
+		if !strings.Contains(one, want) {
+			t.Errorf("ch_one.html does not contain %s:\n%s", want, one)
+		}
+	}
+	two := read("site/two.html")
+	if want := `used in <a href="ch_one.html#glitter-2-0"`; !strings.Contains(two, want) {
+		t.Errorf("two.html does not contain %s:\n%s", want, two)
+	}
+	index := read("site/index.html")
+	for _, want := range []string{
+		`<li><a href="ch_one.html#glitter-2-0">* &#34;prog.go&#34;</a></li>`,
+		`<a href="two.html#glitter-1-0">Helper</a>`,
+		`<li><code>helper</code>: <a class="glitter-ref" href="two.html#glitter-1-0">`,
+	} {
+		if !strings.Contains(index, want) {
+			t.Errorf("index.html does not contain %s:\n%s", want, index)
+		}
+	}
+	// the Go index is written once, on index.html, and not on every page.
+	for name, page := range map[string]string{"book.html": read("site/book.html"), "ch_one.html": one, "two.html": two} {
+		if strings.Contains(page, "glitter-index") {
+			t.Errorf("%s contains the Go index:\n%s", name, page)
+		}
+	}
+	if n := strings.Count(index, `<nav class="glitter-index">`); n != 1 {
+		t.Errorf("index.html has %d Go indexes, want 1:\n%s", n, index)
+	}
+
+	var entries []siteSearchEntry
+	if err := json.Unmarshal([]byte(read("site/search.json")), &entries); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, e := range entries {
+		if e.Page == "two.html" && e.Anchor == "glitter-1-0" && e.Text == "    func helper() {}" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("search index has no entry for Helper: %+v", entries)
+	}
+}
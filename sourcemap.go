@@ -0,0 +1,121 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+//=================================================================================
+// Source maps - where each line of a tangled file came from, as JSON
+//=================================================================================
+
+// SOURCE_MAP_VERSION is the version of the source map format.
+const SOURCE_MAP_VERSION = 1
+
+// sourceMap is the JSON form of the lines of a tangled file. Lines[i] is line
+// i+1 of the file.
+type sourceMap struct {
+	Version int             `json:"version"`
+	File    string          `json:"file"`
+	Lines   []sourceMapLine `json:"lines"`
+}
+
+// sourceMapLine is the JSON form of the segments of a tangled line.
+type sourceMapLine struct {
+	Segments []sourceMapSegment `json:"segments"`
+}
+
+// sourceMapSegment is the JSON form of a Segment.
+type sourceMapSegment struct {
+	Start int                  `json:"start"`
+	Col   int                  `json:"col"`
+	Pos   FilePos              `json:"pos"`
+	Block string               `json:"block"`
+	Chain []sourceMapExpansion `json:"chain"`
+
+	// Directive is the length of the line directive just before Start.
+	Directive int `json:"directive,omitempty"`
+}
+
+// sourceMapExpansion is the JSON form of an Expansion.
+type sourceMapExpansion struct {
+	Block string  `json:"block"`
+	Pos   FilePos `json:"pos"`
+}
+
+// newSourceMapLine returns the JSON form of l.
+func newSourceMapLine(l TangledLine) sourceMapLine {
+	out := sourceMapLine{Segments: make([]sourceMapSegment, 0, len(l.Segments))}
+	for _, s := range l.Segments {
+		chain := make([]sourceMapExpansion, 0)
+		for _, e := range s.Chain() {
+			chain = append(chain, sourceMapExpansion{Block: e.Block, Pos: e.Pos})
+		}
+		out.Segments = append(out.Segments, sourceMapSegment{
+			Start: s.Start, Col: s.Col, Pos: s.Pos, Block: s.Block, Chain: chain,
+			Directive: s.directive,
+		})
+	}
+	return out
+}
+
+// writeSourceMap writes the source map of the tangled file filename, made
+// of lines, to out. Each line of the file gets a line of the JSON, so that
+// the maps of files that change a little also change a little.
+func writeSourceMap(out io.Writer, filename string, lines []TangledLine) error {
+	name, err := json.Marshal(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, `{"version":%d,"file":%s,"lines":[`, SOURCE_MAP_VERSION, name)
+	for i, l := range lines {
+		data, err := json.Marshal(newSourceMapLine(l))
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			w.WriteString(",")
+		}
+		w.WriteString("\n")
+		w.Write(data)
+	}
+	w.WriteString("\n]}\n")
+	return w.Flush()
+}
+
+// lines returns the tangled lines of the map, without their text.
+func (m *sourceMap) lines() []TangledLine {
+	out := make([]TangledLine, 0, len(m.Lines))
+	for _, l := range m.Lines {
+		segs := make([]Segment, 0, len(l.Segments))
+		for _, s := range l.Segments {
+			var chain *chainLink
+			for _, e := range s.Chain {
+				chain = &chainLink{Expansion: Expansion{Block: e.Block, Pos: e.Pos}, up: chain}
+			}
+			segs = append(segs, Segment{
+				Start: s.Start, Col: s.Col, Pos: s.Pos, Block: s.Block, chain: chain,
+				directive: s.Directive,
+			})
+		}
+		out = append(out, TangledLine{Segments: segs})
+	}
+	return out
+}
+
+// readSourceMap returns the tangled lines, without their text, of the source
+// map in data.
+func readSourceMap(data []byte) ([]TangledLine, error) {
+	var m sourceMap
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != SOURCE_MAP_VERSION {
+		return nil, fmt.Errorf("source map of `%s` has version %d, not %d", m.File, m.Version, SOURCE_MAP_VERSION)
+	}
+	return m.lines(), nil
+}
@@ -0,0 +1,922 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+//=================================================================================
+// Tangling - write source files
+//=================================================================================
+
+// Tangler produces source files from glitter sources.
+type Tangler struct {
+	ctx    *RunContext
+	blocks map[string]Block
+
+	// abbrevs maps abbreviated names to the names they stand for.
+	abbrevs map[string]string
+
+	// uses counts the references to each block, or is nil if they have not
+	// been counted since the last blocks were added.
+	uses map[string]int
+
+	// memo holds the expansion of each block referred to more than once that
+	// the file being tangled has used so far. base is the chain of the block
+	// whose expansion is being memoized, if any.
+	memo map[string][]TangledLine
+	base *chainLink
+
+	// summary counts what happened to the files written by WriteFiles.
+	summary TangleSummary
+
+	// sources holds the glitter files read, and origins gives the glitter
+	// file that the first top-level block of each output was read from.
+	sources map[string]Void
+	origins map[string]string
+}
+
+// tangledLines is a list of tangled lines and their total size in bytes.
+type tangledLines struct {
+	lines []TangledLine
+	size  int
+}
+
+// NewTangler creates a Tangler for the given run, which must be a ModeTangle
+// run.
+func NewTangler(ctx *RunContext) *Tangler {
+	return &Tangler{
+		ctx:     ctx,
+		blocks:  make(map[string]Block),
+		abbrevs: make(map[string]string),
+		sources: make(map[string]Void),
+		origins: make(map[string]string),
+	}
+}
+
+// Tangle reads the given files and writes all of the source files they
+// describe.
+func Tangle(filenames []string, ctx *RunContext) error {
+	t := NewTangler(ctx)
+	if err := t.Read(NewGlitterScanner(filenames, ctx)); err != nil {
+		return err
+	}
+	return t.WriteFiles()
+}
+
+// canonicalCodeName converts name to a canonical form, which removes leading
+// and trailiing spaces, replaces runs of whitespace with a single space, and,
+// if the name does not start with *, it will be all lowercased.
+func canonicalCodeName(name string) string {
+	name = spaceRegexp.ReplaceAllString(strings.TrimSpace(name), " ")
+	if !isTopLevelName(name) {
+		name = strings.ToLower(name)
+	}
+	return replaceNoOpChars(name)
+}
+
+// isTopLevelName returns true if this is a top-level ref, meaning that the code name
+// starts with *
+func isTopLevelName(name string) bool {
+	return topLevelStart.MatchString(name)
+}
+
+// parseTopLevelName parses a code block name of the following form:
+//
+//	<<* "filename" 1234>>
+//
+// The "filename" and 1234 are both optional, but must be in that order if
+// given. If 1234 is omitted, it is 0. If "filename" is omitted, it is
+// defaultFile. The "filename" must be contained in quotes.
+func parseTopLevelName(name, defaultFile string) (filename string, order int, ok bool) {
+	subs := topLevelRegex.FindStringSubmatch(name)
+	if subs == nil {
+		return
+	}
+	ok = true
+	filename = defaultFile
+	for _, g := range subs[1:] {
+		if strings.HasPrefix(g, `"`) {
+			// filename without the quotes
+			filename = filepath.Clean(trimQuotes(g))
+		} else {
+			o, err := strconv.Atoi(g)
+			if err == nil {
+				order = o
+			}
+		}
+	}
+	return
+}
+
+// splitTopLevelName splits a well-formed, complete top-level name into its
+// components.
+func splitTopLevelName(name string) (string, int, error) {
+	subs := topLevelRegex.FindStringSubmatch(name)
+	if subs == nil || len(subs) != 3 {
+		return "", 0, fmt.Errorf("internally incorrectly constructed top-level `%s`", name)
+	}
+	n, err := strconv.Atoi(subs[2])
+	if err != nil {
+		return "", 0, fmt.Errorf("internally incorrectly constructed top-level `%s`", name)
+	}
+
+	return trimQuotes(subs[1]), n, nil
+}
+
+// trimQuotes removes leading and trailing whitespace and a single " from the
+// start and end of the string (if they exist)
+func trimQuotes(s string) string {
+	s = strings.TrimSpace(s)
+	s, _ = strings.CutPrefix(s, `"`)
+	s, _ = strings.CutSuffix(s, `"`)
+	return s
+}
+
+// removeBlankLines removes blank lines from the start and end of the block.
+func removeBlankLines(block Block) Block {
+	var first, last int
+	for first = range block.lines {
+		if !emptyLineRegex.MatchString(block.lines[first].Line()) {
+			break
+		}
+	}
+	for last = len(block.lines) - 1; last >= first; last-- {
+		if !emptyLineRegex.MatchString(block.lines[last].Line()) {
+			break
+		}
+	}
+	block.lines = block.lines[first : last+1]
+	return block
+}
+
+// whiteSpacePrefixLength returns the number of whitespace runes that prefix
+// the string.
+func whitespacePrefixLength(line string) int {
+	for i, c := range line {
+		if !unicode.IsSpace(c) {
+			return i
+		}
+	}
+	return utf8.RuneCountInString(line)
+}
+
+// deindentBlock finds the leftmost start point of a line removes whitespace
+// before that point.
+func deindentBlock(block Block) Block {
+	minSpace := -1
+	for _, line := range block.lines {
+		if len(strings.TrimSpace(line.Line())) == 0 {
+			continue
+		}
+		if minSpace < 0 {
+			minSpace = len(line.Line())
+		}
+		minSpace = min(minSpace, whitespacePrefixLength(line.Line()))
+	}
+	if minSpace < 0 {
+		return block
+	}
+	for i, line := range block.lines {
+		rl := []rune(line.line)
+		if len(rl) >= minSpace {
+			block.lines[i].line = string(rl[minSpace:])
+			block.lines[i].col += len(line.line) - len(block.lines[i].line)
+		}
+	}
+	return block
+}
+
+// debugPrintBlocks writes all the blocks out in a simple format.
+func debugPrintBlocks(blocks map[string][]string, out io.Writer) {
+	for n, c := range blocks {
+		fmt.Fprintf(out, "<<%s>>= {\n", n)
+		for _, ll := range c {
+			fmt.Fprintf(out, "\t%s\n", ll)
+		}
+		fmt.Fprintln(out, "}")
+	}
+}
+
+// createOutputFilename returns a string with the output filename for the given
+// input filename
+func createOutputFilename(name string) string {
+	name = filepath.Clean(name)
+	// remove the suffix if it is present
+	name, _ = strings.CutSuffix(name, GLITTER_EXT)
+	return name + TANGLE_OUT_EXT
+}
+
+// Read reads all of the lines from the scanner, recursively including
+// @include files, and adds the code blocks it finds to the Tangler.
+func (t *Tangler) Read(scanner *GlitterScanner) error {
+	if t.ctx.Mode != ModeTangle {
+		return fmt.Errorf("cannot tangle in a %s run", t.ctx.Mode)
+	}
+	doc, err := Parse(scanner)
+	if err != nil {
+		return err
+	}
+	t.AddDocument(doc)
+	return nil
+}
+
+// AddDocument adds the code blocks of a parsed document to the Tangler.
+// Blocks with the same name are concatenated in the order they are added.
+func (t *Tangler) AddDocument(doc *Document) {
+	maps.Copy(t.abbrevs, doc.Abbreviations)
+	t.uses = nil
+	for _, c := range doc.Chunks {
+		t.sources[c.Pos().filename] = Void{}
+	}
+	for _, c := range doc.CodeChunks() {
+		if _, ok := t.origins[c.File]; c.TopLevel && !ok {
+			t.origins[c.File] = c.pos.filename
+		}
+		b2 := Block{}
+		for _, l := range c.Lines {
+			b2.AppendLine(l.SourceLine)
+		}
+		b2 = removeBlankLines(deindentBlock(b2))
+		b1, ok := t.blocks[c.Canonical]
+		if ok && len(b2.lines) > 0 {
+			b1.starts = append(b1.starts, len(b1.lines))
+		}
+		t.blocks[c.Canonical] = appendBlocks(b1, b2)
+	}
+}
+
+// getTopLevelBlocks returns a list of the names of all the top-level blocks.
+func getTopLevelBlocks(blocks map[string]Block) (out []string, err error) {
+	out = make([]string, 0)
+	for k := range blocks {
+		if isTopLevelName(k) {
+			out = append(out, k)
+		}
+	}
+
+	// if the comparison function panics, catch the error and return in in the
+	// normal way.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cmp error: %v", r)
+		}
+	}()
+	slices.SortFunc(out, func(a, b string) int {
+		fa, na, err := splitTopLevelName(a)
+		if err != nil {
+			panic(err)
+		}
+		fb, nb, err := splitTopLevelName(b)
+		if err != nil {
+			panic(err)
+		}
+		if n := cmp.Compare(fa, fb); n != 0 {
+			return n
+		}
+		return cmp.Compare(na, nb)
+	})
+	return
+}
+
+// TangledLine is a line of a tangled file, together with the places in the
+// sources that it was read from.
+type TangledLine struct {
+	Text string
+
+	// Segments holds, in order, the pieces of the line that were read from
+	// a single source line. A line made by expanding a reference has a piece
+	// for the text before the reference, one for the referenced line, and
+	// one for the text after it. Blank lines that separate top-level blocks
+	// have no segments.
+	Segments []Segment
+}
+
+// Segment is a piece of a tangled line that was read from a single line of a
+// code block.
+type Segment struct {
+	// Start is the byte offset in the tangled line where the piece starts,
+	// and Col is the byte offset of the same place in the source line.
+	Start int
+	Col   int
+	Pos   FilePos
+
+	// Block is the canonical name of the block the source line is part of.
+	Block string
+
+	chain *chainLink
+
+	// directive is the length of the line directive just before Start, which
+	// marks the start of the piece and is not part of the source line.
+	directive int
+}
+
+// chainLink is the last reference of a chain of expanded references. Chains
+// share their beginnings, so that a deeply nested block does not copy the
+// whole chain for each line.
+type chainLink struct {
+	Expansion
+	up *chainLink
+}
+
+// Chain returns the references, outermost first, that were expanded to reach
+// the source line of the segment from a top-level block. The last one refers
+// to Block.
+func (s Segment) Chain() []Expansion {
+	return s.chain.expansions()
+}
+
+// expansions returns the references of the chain, outermost first.
+func (c *chainLink) expansions() []Expansion {
+	out := make([]Expansion, 0)
+	for ; c != nil; c = c.up {
+		out = append(out, c.Expansion)
+	}
+	slices.Reverse(out)
+	return out
+}
+
+// contains returns true if the chain has a reference to the named block.
+func (c *chainLink) contains(name string) bool {
+	for ; c != nil; c = c.up {
+		if c.Block == name {
+			return true
+		}
+	}
+	return false
+}
+
+// rebase returns the chain c, which starts from a memoized block, as it is
+// when the chain of the memoized block is base.
+func (c *chainLink) rebase(base *chainLink) *chainLink {
+	if c == nil {
+		return base
+	}
+	if base == nil {
+		return c
+	}
+	return &chainLink{Expansion: c.Expansion, up: c.up.rebase(base)}
+}
+
+// Expansion is a << .. >> reference that was expanded while tangling.
+type Expansion struct {
+	// Block is the canonical name of the referenced block, and Pos is the
+	// position of the reference.
+	Block string
+	Pos   FilePos
+}
+
+// cycleError returns the error for a reference, at pos, to a block that is
+// already being expanded through chain.
+func cycleError(chain []Expansion, block string, pos FilePos) error {
+	return ErrorWithFile(pos, "reference cycle: %s", cycleSteps(chain, block, pos))
+}
+
+// cycleSteps describes the cycle closed by a reference, at pos, to a block
+// that is already being expanded through chain. It lists each reference of
+// the cycle, from the first reference to the block, with its position.
+func cycleSteps(chain []Expansion, block string, pos FilePos) string {
+	i := slices.IndexFunc(chain, func(e Expansion) bool { return e.Block == block })
+	steps := make([]string, 0, len(chain)-i+1)
+	for _, e := range append(slices.Clone(chain[i:]), Expansion{Block: block, Pos: pos}) {
+		steps = append(steps, fmt.Sprintf("`%s` (%s:%d)", e.Block, e.Pos.Filename(), e.Pos.LineNo()))
+	}
+	return strings.Join(steps, " → ")
+}
+
+// Origin returns the segment of the line that contains byte offset off, and
+// false if the line has no segments. The line directive before a segment is
+// part of it, as is anything before the first segment.
+func (l *TangledLine) Origin(off int) (Segment, bool) {
+	if len(l.Segments) == 0 {
+		return Segment{}, false
+	}
+	i := len(l.Segments) - 1
+	for i > 0 && l.Segments[i].Start-l.Segments[i].directive > off {
+		i--
+	}
+	return l.Segments[i], true
+}
+
+// MainOrigin returns the segment that most of the line is about, and the
+// offset in the line of its first byte that is not blank: of the segments
+// with more than blanks in the line, the one reached through the most
+// references. That is the referenced line in a line made by expanding a
+// reference. A line that is all blanks is about its first segment. It returns
+// false if the line has no segments.
+func (l *TangledLine) MainOrigin() (Segment, int, bool) {
+	var main Segment
+	at, depth := -1, -1
+	for i, s := range l.Segments {
+		end := len(l.Text)
+		if i+1 < len(l.Segments) {
+			end = min(end, l.Segments[i+1].Start)
+		}
+		if s.Start >= end {
+			continue
+		}
+		text := l.Text[s.Start:end]
+		first := len(text) - len(strings.TrimLeft(text, " \t"))
+		if first == len(text) {
+			continue
+		}
+		if d := len(s.Chain()); d > depth {
+			main, at, depth = s, s.Start+first, d
+		}
+	}
+	if at < 0 && len(l.Segments) > 0 {
+		return l.Segments[0], l.Segments[0].Start, true
+	}
+	return main, at, at >= 0
+}
+
+// SourceCol returns the byte offset in the source line of the segment of
+// byte offset off of the tangled line, which must be in the segment. An
+// offset before Start, such as one in a line directive, is the start of the
+// source text of the segment.
+func (s Segment) SourceCol(off int) int {
+	return max(0, s.Col+max(0, off-s.Start))
+}
+
+// segmentsAfter returns the segments of the text of line that follows byte
+// offset off, as they would be if that text started at offset base. There are
+// none if no text follows off.
+func segmentsAfter(line TangledLine, off, base int) []Segment {
+	o, ok := line.Origin(off)
+	if !ok || off >= len(line.Text) {
+		return nil
+	}
+	o.Col = o.SourceCol(off)
+	o.Start = base
+	o.directive = 0
+	out := []Segment{o}
+	for _, s := range line.Segments {
+		if s.Start > off {
+			s.Start += base - off
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// escapedOffset returns the offset in replaceNoOpChars(s) of byte offset off
+// in s.
+func escapedOffset(s string, off int) int {
+	n := off
+	for _, m := range escapeRegex.FindAllStringIndex(s, -1) {
+		if m[0] >= off {
+			break
+		}
+		n--
+	}
+	return n
+}
+
+// emit appends line to out. It is an error if this makes out larger than the
+// run's MaxTangleSize.
+func (t *Tangler) emit(line TangledLine, out *tangledLines) error {
+	out.lines = append(out.lines, line)
+	out.size += len(line.Text) + 1
+	if limit := t.ctx.MaxTangleSize; limit > 0 && out.size > limit {
+		o, _ := line.Origin(0)
+		return ErrorWithFile(o.Pos, "tangled file is larger than the limit of %d bytes", limit)
+	}
+	return nil
+}
+
+// countUses counts the references to each block in the blocks read so far.
+func (t *Tangler) countUses() map[string]int {
+	if t.uses != nil {
+		return t.uses
+	}
+	t.uses = make(map[string]int)
+	for _, b := range t.blocks {
+		for _, l := range b.lines {
+			for _, m := range codeRefRegex.FindAllStringSubmatch(l.Line(), -1) {
+				name := canonicalCodeName(m[1])
+				if full, ok := t.abbrevs[name]; ok {
+					name = full
+				}
+				t.uses[name]++
+			}
+		}
+	}
+	return t.uses
+}
+
+// memoized returns the lines of the named block with every << >> reference
+// expanded, as they would be if the block were referred to at the start of
+// an empty line, with the Chains of their segments starting from the block.
+// The block is expanded the first time it is referred to, at pos, by a line
+// whose chain is chain, and the expansion is reused after that.
+func (t *Tangler) memoized(name string, b Block, chain *chainLink) ([]TangledLine, error) {
+	if lines, ok := t.memo[name]; ok {
+		return lines, nil
+	}
+	base := t.base
+	t.base = chain.rebase(base)
+	out := &tangledLines{lines: make([]TangledLine, 0, len(b.lines))}
+	err := t.expandBlock(name, b, nil, out)
+	t.base = base
+	if err != nil {
+		return nil, err
+	}
+	t.memo[name] = out.lines
+	return out.lines, nil
+}
+
+// expandLine will recursively substitute << >> references, trying to maintain
+// correct line breaks and indentation. The expanded lines are appended to out.
+// A block that is referred to more than once is expanded once, and its
+// expansion is copied, with the indentation of each use, after that.
+func (t *Tangler) expandLine(line TangledLine, out *tangledLines) error {
+	var pos []int
+	if strings.Contains(line.Text, "<<") {
+		pos = codeRefRegex.FindStringSubmatchIndex(line.Text)
+	}
+	// if there are no substitutions to be made, the line is all we have
+	if pos == nil {
+		return t.emit(line, out)
+	}
+
+	startRef := pos[0]
+	endRef := pos[1]
+	blockName := canonicalCodeName(strings.TrimSpace(line.Text[pos[2]:pos[3]]))
+	if full, ok := t.abbrevs[blockName]; ok {
+		blockName = full
+	}
+	from, _ := line.Origin(startRef)
+	loc := from.Pos
+
+	if isTopLevelName(blockName) {
+		return ErrorWithFile(loc, "cannot reference top-level block `%s`", blockName)
+	}
+	chain := &chainLink{Expansion: Expansion{Block: blockName, Pos: loc}, up: from.chain}
+	if from.chain.contains(blockName) || t.base.contains(blockName) {
+		return cycleError(from.chain.rebase(t.base).expansions(), blockName, loc)
+	}
+
+	// the lines after the first are indented to line up with the first,
+	// which the line directives before the reference do not take up room in.
+	before := line.Text[:startRef]
+	after := line.Text[endRef:]
+	indent := utf8.RuneCountInString(before)
+	beforeSegs := make([]Segment, 0, len(line.Segments))
+	for _, s := range line.Segments {
+		if s.Start <= startRef {
+			beforeSegs = append(beforeSegs, s)
+			indent -= utf8.RuneCountInString(line.Text[s.Start-s.directive : s.Start])
+		}
+	}
+
+	refdBlock, ok := t.blocks[blockName]
+	if !ok {
+		return ErrorWithFile(loc, "unknown block reference `%s`", blockName)
+	}
+
+	// if the referenced block is empty, it becomes a single space
+	if len(refdBlock.lines) == 0 {
+		text := before + " "
+		segs := append(beforeSegs, segmentsAfter(line, endRef, len(text))...)
+		return t.expandLine(TangledLine{Text: text + after, Segments: segs}, out)
+	}
+
+	// otherwise, we turn it into this:
+	// BEFORE<<------>>AFTER
+	// beforeLINE1
+	//       LINE2
+	//       LINE3
+	//       LINEnafter
+	// A block used once is expanded in place, line by line. For a block used
+	// more than once, the lines are its memoized expansion, and only the last
+	// line can have references left to expand, in AFTER.
+	var refLines []TangledLine
+	expanded := t.countUses()[blockName] > 1
+	if expanded {
+		var err error
+		if refLines, err = t.memoized(blockName, refdBlock, chain); err != nil {
+			return err
+		}
+	} else {
+		refLines = t.blockLines(blockName, refdBlock, chain)
+	}
+
+	for i, refline := range refLines {
+		prefix := strings.Repeat(" ", indent)
+		segs := make([]Segment, 0, len(beforeSegs)+len(refline.Segments)+1)
+		if i == 0 {
+			prefix = before
+			segs = append(segs, beforeSegs...)
+		}
+		for _, s := range refline.Segments {
+			s.Start += len(prefix)
+			if expanded {
+				s.chain = s.chain.rebase(chain)
+			}
+			segs = append(segs, s)
+		}
+		text := prefix + refline.Text
+		if i < len(refLines)-1 && expanded {
+			if err := t.emit(TangledLine{Text: text, Segments: segs}, out); err != nil {
+				return err
+			}
+			continue
+		}
+		if i == len(refLines)-1 {
+			segs = append(segs, segmentsAfter(line, endRef, len(text))...)
+			text += after
+		}
+		if err := t.expandLine(TangledLine{Text: text, Segments: segs}, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockLines returns the lines of the named block, unexpanded, as tangled
+// lines whose segments have the given chain. The first line is prefixed with
+// its line command.
+func (t *Tangler) blockLines(name string, b Block, chain *chainLink) []TangledLine {
+	out := make([]TangledLine, 0, len(b.lines))
+	// b.starts is in increasing order, so it is walked along with the lines.
+	next := 0
+	for i, line := range b.lines {
+		for next < len(b.starts) && b.starts[next] < i {
+			next++
+		}
+		prefix := ""
+		if i == 0 || next < len(b.starts) && b.starts[next] == i {
+			prefix = t.ctx.lineCommand(line.Pos())
+		}
+		out = append(out, TangledLine{
+			Text: prefix + line.Line(),
+			Segments: []Segment{{
+				Start: len(prefix), Col: line.col, Pos: line.Pos(), Block: name, chain: chain,
+				directive: len(prefix),
+			}},
+		})
+	}
+	return out
+}
+
+// expandBlock expands all << >> refs in the code block with the given name,
+// whose chain is chain, and appends its lines to out.
+func (t *Tangler) expandBlock(name string, b Block, chain *chainLink, out *tangledLines) error {
+	for _, tl := range t.blockLines(name, b, chain) {
+		if err := t.expandLine(tl, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OutputFiles returns the sorted names of the files that the top-level blocks
+// read so far will be written to.
+func (t *Tangler) OutputFiles() ([]string, error) {
+	topBlocks, err := getTopLevelBlocks(t.blocks)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, 0)
+	for _, b := range topBlocks {
+		f, _, err := splitTopLevelName(b)
+		if err != nil {
+			return nil, err
+		}
+		if len(out) == 0 || out[len(out)-1] != f {
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// TangleFile expands every top-level block that belongs in filename and
+// returns, in order, the lines of the file with the `#` escapes replaced.
+func (t *Tangler) TangleFile(filename string) ([]TangledLine, error) {
+	topBlocks, err := getTopLevelBlocks(t.blocks)
+	if err != nil {
+		return nil, err
+	}
+	tl := &tangledLines{lines: make([]TangledLine, 0)}
+	t.memo = make(map[string][]TangledLine)
+	t.base = nil
+	for _, b := range topBlocks {
+		f, _, err := splitTopLevelName(b)
+		if err != nil {
+			return nil, err
+		}
+		if f != filename {
+			continue
+		}
+		// writing a new block to the same file, separate with a blank line.
+		if len(tl.lines) > 0 {
+			tl.lines = append(tl.lines, TangledLine{})
+		}
+		if err = t.expandBlock(b, t.blocks[b], nil, tl); err != nil {
+			return nil, err
+		}
+	}
+	t.memo = nil
+	out := tl.lines
+	for i, l := range out {
+		if !strings.Contains(l.Text, "#") {
+			continue
+		}
+		for j, s := range l.Segments {
+			out[i].Segments[j].Start = escapedOffset(l.Text, s.Start)
+		}
+		out[i].Text = replaceNoOpChars(l.Text)
+	}
+	return out, nil
+}
+
+// WriteFile expands every top-level block that belongs in filename and
+// writes them, in order, to out.
+func (t *Tangler) WriteFile(filename string, out io.Writer) error {
+	lines, err := t.TangleFile(filename)
+	if err != nil {
+		return err
+	}
+	return writeLines(out, lines)
+}
+
+// writeLines writes the text of lines to out, one per line.
+func writeLines(out io.Writer, lines []TangledLine) error {
+	w := bufio.NewWriter(out)
+	for _, l := range lines {
+		writeStrings(w, l.Text, "\n")
+	}
+	return w.Flush()
+}
+
+// TangleSummary counts the output files of a call to WriteFiles by what
+// happened to them.
+type TangleSummary struct {
+	// Written counts the files whose contents changed, New the files that
+	// did not exist, and Unchanged the files that already held exactly what
+	// tangle produced and so were not written. Removed counts the files
+	// written by an earlier tangle that are no longer produced.
+	Written   int
+	New       int
+	Unchanged int
+	Removed   int
+}
+
+// String returns the counts as a sentence.
+func (s TangleSummary) String() string {
+	return fmt.Sprintf("%d files written, %d new, %d unchanged, %d removed",
+		s.Written, s.New, s.Unchanged, s.Removed)
+}
+
+// Summary returns what happened to the output files in the last call to
+// WriteFiles.
+func (t *Tangler) Summary() TangleSummary {
+	return t.summary
+}
+
+// writeIfChanged writes data to the named file of outputs, unless the file
+// already holds exactly data. If outputs cannot be read, the file is always
+// written. It returns whether the file existed and whether it was written.
+func writeIfChanged(outputs WriteFS, name string, data []byte) (existed, written bool, err error) {
+	existed = true
+	if fsys, ok := outputs.(fs.FS); ok {
+		old, err := fs.ReadFile(fsys, name)
+		switch {
+		case err == nil && bytes.Equal(old, data):
+			return true, false, nil
+		case errors.Is(err, fs.ErrNotExist):
+			existed = false
+		}
+	}
+	out, err := outputs.Create(name)
+	if err != nil {
+		return existed, false, err
+	}
+	_, err = out.Write(data)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return existed, err == nil, err
+}
+
+// WriteFiles creates, in the run's Outputs, every output file described by
+// the top-level blocks read so far. Each file is tangled in memory first, and
+// files that would not change are not written, so that their modification
+// times are kept.
+//
+// The files are listed in the MANIFEST_FILE of the Outputs. Files listed
+// there by an earlier tangle of the same glitter files that are no longer
+// produced are removed, unless they have been changed since. What happened
+// to the files is logged and is given by Summary. Where each line of the
+// files came from is kept in the run, so that ExecuteCommand can give the
+// places in the glitter sources of positions in the files. If the run's
+// SourceMaps is set, it is also written next to each file, in a file named
+// with SOURCE_MAP_EXT added, which is listed in the manifest as well.
+//
+// If the run's FormatGo is set, Go files are formatted before they are
+// compared and written. A Go file with syntax errors is written as it is,
+// and the errors, at their places in the glitter sources, are returned once
+// the other files have been written.
+func (t *Tangler) WriteFiles() error {
+	t.summary = TangleSummary{}
+	files, err := t.OutputFiles()
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("no top-level code blocks found")
+	}
+	t.ctx.Info(2, "%d total output files found", len(files))
+	old, err := readManifest(t.ctx)
+	if err != nil {
+		return err
+	}
+
+	if t.ctx.positions == nil {
+		t.ctx.positions = make(map[string][]TangledLine)
+	}
+	entries := make([]manifestEntry, 0, len(files))
+	tangled := make(map[string]Void)
+	formatErrs := make([]error, 0)
+	for _, f := range files {
+		lines, err := t.TangleFile(f)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := writeLines(&buf, lines); err != nil {
+			return err
+		}
+		data := buf.Bytes()
+		if t.ctx.FormatGo && filepath.Ext(f) == TANGLE_OUT_EXT {
+			if out, outLines, err := formatGo(f, data, lines); err != nil {
+				formatErrs = append(formatErrs, err)
+			} else {
+				data, lines = out, outLines
+			}
+		}
+		t.ctx.positions[filepath.ToSlash(filepath.Clean(f))] = lines
+		existed, written, err := writeIfChanged(t.ctx.Outputs, f, data)
+		switch {
+		case err != nil:
+			return err
+		case !written:
+			t.ctx.Info(1, "`%s` is unchanged", f)
+			t.summary.Unchanged++
+		case existed:
+			t.ctx.Info(1, "Wrote `%s`", f)
+			t.summary.Written++
+		default:
+			t.ctx.Info(1, "Wrote new file `%s`", f)
+			t.summary.New++
+		}
+		entries = append(entries, manifestEntry{File: f, Source: t.origins[f], Sum: checksum(data)})
+		tangled[f] = Void{}
+
+		if t.ctx.SourceMaps {
+			name := f + SOURCE_MAP_EXT
+			var sm bytes.Buffer
+			if err := writeSourceMap(&sm, f, lines); err != nil {
+				return err
+			}
+			if _, written, err := writeIfChanged(t.ctx.Outputs, name, sm.Bytes()); err != nil {
+				return err
+			} else if written {
+				t.ctx.Info(1, "Wrote source map `%s`", name)
+			}
+			entries = append(entries, manifestEntry{File: name, Source: t.origins[f], Sum: checksum(sm.Bytes())})
+			tangled[name] = Void{}
+		}
+	}
+
+	// keep what other tangles wrote, and stale files that were not removed.
+	kept, err := t.removeStale(old, tangled)
+	if err != nil {
+		return err
+	}
+	entries = append(entries, kept...)
+	for _, e := range old {
+		if _, ok := tangled[e.File]; !ok && !t.isStale(e, tangled) {
+			entries = append(entries, e)
+		}
+	}
+	slices.SortFunc(entries, func(a, b manifestEntry) int { return cmp.Compare(a.File, b.File) })
+	if err := writeManifest(t.ctx, entries); err != nil {
+		return err
+	}
+	t.ctx.Info(0, "%s", t.summary)
+	return errors.Join(formatErrs...)
+}
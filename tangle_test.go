@@ -0,0 +1,677 @@
+package glitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const tangleTestSource = `@glitter top
+@: The program.
+<<* "out.go">>=
+    package main
+
+    <<Functions>>
+@: More functions.
+<<Functions>>=
+    func f() {
+        <<Body of f>>
+    }
+<<Body of f>>=
+    return
+`
+
+func TestTangleFromReader(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Config["TangleLineRef"] = ""
+
+	tg := NewTangler(ctx)
+	err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(tangleTestSource), ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := tg.OutputFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0] != "out.go" {
+		t.Fatalf("OutputFiles() = %v, want [out.go]", files)
+	}
+
+	var out strings.Builder
+	if err := tg.WriteFile("out.go", &out); err != nil {
+		t.Fatal(err)
+	}
+	want := "package main\n\nfunc f() {\n    return\n}\n"
+	if out.String() != want {
+		t.Errorf("WriteFile() = %q, want %q", out.String(), want)
+	}
+}
+
+func TestCanonicalCodeName(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"  Foo   Bar ", "foo bar"},
+		{`* "Out.go"  1`, `* "Out.go" 1`},
+		{"a ## b", "a # b"},
+	}
+	for _, tt := range tests {
+		if got := canonicalCodeName(tt.in); got != tt.want {
+			t.Errorf("canonicalCodeName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTangleFileSegments(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Config["TangleLineRef"] = ""
+
+	tg := NewTangler(ctx)
+	err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(tangleTestSource), ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines, err := tg.TangleFile("out.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 5 || lines[3].Text != "    return" {
+		t.Fatalf("TangleFile() = %+v", lines)
+	}
+	// "    return" comes from the indentation of the reference in line 10
+	// and the deindented line 13.
+	s, _ := lines[3].Origin(0)
+	if s.Block != "functions" || s.Pos.LineNo() != 10 || s.Col != 4 {
+		t.Errorf("Origin(0) = %+v", s)
+	}
+	s, _ = lines[3].Origin(4)
+	if s.Block != "body of f" || s.Pos.LineNo() != 13 || s.Col != 4 {
+		t.Errorf("Origin(4) = %+v", s)
+	}
+}
+
+func TestTangleCycle(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	src := `<<* "out.go">>=
+    <<A>> <<B>>
+<<A>>=
+    <<B>>
+<<B>>=
+    <<C>>
+<<C>>=
+    x := 1
+    <<A>>
+`
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := tg.TangleFile("out.go")
+	want := "prog.gw:9: reference cycle: `a` (prog.gw:2) → `b` (prog.gw:4) → `c` (prog.gw:6) → `a` (prog.gw:9)"
+	if err == nil || err.Error() != want {
+		t.Errorf("TangleFile() error = %v, want %s", err, want)
+	}
+}
+
+func TestTangleCyclePositions(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	// A is used twice, so it is expanded once and the cycle is found inside
+	// its memoized expansion.
+	src := `<<* "out.go">>=
+    <<A>>
+    <<A>>
+<<A>>=
+    <<B>>
+<<B>>=
+    <<A>>
+`
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := tg.TangleFile("out.go")
+	if err == nil {
+		t.Fatal("TangleFile() did not find the cycle")
+	}
+	_, steps, ok := strings.Cut(err.Error(), "reference cycle: ")
+	if !ok {
+		t.Fatalf("TangleFile() error = %v", err)
+	}
+	hop := regexp.MustCompile("^`[^`]+` \\(prog\\.gw:[0-9]+\\)$")
+	for _, step := range strings.Split(steps, " → ") {
+		if !hop.MatchString(step) {
+			t.Errorf("step %q of %q has no position", step, steps)
+		}
+	}
+	if want := "`a` (prog.gw:2) → `b` (prog.gw:5) → `a` (prog.gw:7)"; steps != want {
+		t.Errorf("cycle = %s, want %s", steps, want)
+	}
+}
+
+func TestTangleNoFalseCycle(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Config["TangleLineRef"] = ""
+	src := `<<* "out.go">>=
+    <<A>> <<B>>
+<<A>>=
+    a
+<<B>>=
+    <<A>>
+`
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := tg.WriteFile("out.go", &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "a a\n" {
+		t.Errorf("WriteFile() = %q, want %q", out.String(), "a a\n")
+	}
+}
+
+func TestTangleMaxSize(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.MaxTangleSize = 1000
+	src := `<<* "out.go">>=
+    <<A>>
+<<A>>=
+    <<B>>
+    <<B>>
+<<B>>=
+    <<C>>
+    <<C>>
+<<C>>=
+    <<D>>
+    <<D>>
+<<D>>=
+    <<E>>
+    <<E>>
+<<E>>=
+    some code that is repeated sixteen times
+`
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	_, err := tg.TangleFile("out.go")
+	if err == nil || !strings.Contains(err.Error(), "larger than the limit of 1000 bytes") {
+		t.Errorf("TangleFile() error = %v, want the size limit", err)
+	}
+	ctx.MaxTangleSize = 0
+	if _, err := tg.TangleFile("out.go"); err != nil {
+		t.Errorf("TangleFile() with no limit: %v", err)
+	}
+}
+
+// benchmarkTangle reads src and tangles out.go b.N times.
+func benchmarkTangle(b *testing.B, src string) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.MaxTangleSize = 0
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for range b.N {
+		if _, err := tg.TangleFile("out.go"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkTangleManyBlocks tangles a file made of 10,000 blocks, each
+// referred to once.
+func BenchmarkTangleManyBlocks(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("<<* \"out.go\">>=\n")
+	for i := range 10000 {
+		fmt.Fprintf(&sb, "    <<Block %d>>\n", i)
+	}
+	for i := range 10000 {
+		fmt.Fprintf(&sb, "@: Block %d.\n<<Block %d>>=\n    func f%d() {\n        return\n    }\n", i, i, i)
+	}
+	benchmarkTangle(b, sb.String())
+}
+
+// BenchmarkTangleDeepNesting tangles a chain of 1,000 blocks, each referring
+// to the next.
+func BenchmarkTangleDeepNesting(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("<<* \"out.go\">>=\n    <<Level 0>>\n")
+	for i := range 1000 {
+		fmt.Fprintf(&sb, "<<Level %d>>=\n    x%d := 1\n", i, i)
+		if i < 999 {
+			fmt.Fprintf(&sb, "    <<Level %d>>\n", i+1)
+		}
+	}
+	benchmarkTangle(b, sb.String())
+}
+
+// BenchmarkTangleFanIn tangles a file that refers to one large block from
+// 10,000 places.
+func BenchmarkTangleFanIn(b *testing.B) {
+	var sb strings.Builder
+	sb.WriteString("<<* \"out.go\">>=\n")
+	for range 10000 {
+		sb.WriteString("    <<Shared>>\n")
+	}
+	sb.WriteString("<<Shared>>=\n")
+	for i := range 10 {
+		fmt.Fprintf(&sb, "    <<Part %d>>\n", i)
+	}
+	for i := range 10 {
+		fmt.Fprintf(&sb, "<<Part %d>>=\n    y%d := 2\n", i, i)
+	}
+	benchmarkTangle(b, sb.String())
+}
+
+func TestTangleSegmentChains(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Config["TangleLineRef"] = ""
+	src := `<<* "out.go">>=
+    <<Once>>
+    <<Twice>>
+<<Once>>=
+    <<Twice>>
+<<Twice>>=
+    x := 1
+`
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	lines, err := tg.TangleFile("out.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"once@prog.gw:2 twice@prog.gw:5",
+		"twice@prog.gw:3",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d", len(lines), len(want))
+	}
+	for i, l := range lines {
+		s, _ := l.Origin(0)
+		steps := make([]string, 0)
+		for _, e := range s.Chain() {
+			steps = append(steps, fmt.Sprintf("%s@%s:%d", e.Block, e.Pos.Filename(), e.Pos.LineNo()))
+		}
+		if got := strings.Join(steps, " "); l.Text != "x := 1" || got != want[i] {
+			t.Errorf("line %d: %q with chain %q, want %q", i, l.Text, got, want[i])
+		}
+	}
+}
+
+// createCountingFS is a MemFS that counts the files created in it.
+type createCountingFS struct {
+	*MemFS
+	created []string
+}
+
+func (c *createCountingFS) Create(name string) (io.WriteCloser, error) {
+	c.created = append(c.created, name)
+	return c.MemFS.Create(name)
+}
+
+func TestWriteFilesIfChanged(t *testing.T) {
+	out := &createCountingFS{MemFS: NewMemFS()}
+	tangle := func(body string) TangleSummary {
+		t.Helper()
+		ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+		ctx.Logger.SetOutput(io.Discard)
+		ctx.Config["TangleLineRef"] = ""
+		ctx.Outputs = out
+		out.created = nil
+		src := "<<* \"a.go\">>=\n    package a\n<<* \"b.go\">>=\n    package b\n    " + body + "\n"
+		tg := NewTangler(ctx)
+		if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tg.WriteFiles(); err != nil {
+			t.Fatal(err)
+		}
+		return tg.Summary()
+	}
+
+	if got, want := tangle("var x = 1"), (TangleSummary{New: 2}); got != want {
+		t.Errorf("first tangle: %v, want %v", got, want)
+	}
+	if got, want := tangle("var x = 1"), (TangleSummary{Unchanged: 2}); got != want || len(out.created) != 0 {
+		t.Errorf("second tangle: %v creating %v, want %v creating nothing", got, out.created, want)
+	}
+	// the manifest records the new checksum of b.go.
+	if got, want := tangle("var x = 2"), (TangleSummary{Written: 1, Unchanged: 1}); got != want ||
+		!slices.Equal(out.created, []string{"b.go", MANIFEST_FILE}) {
+		t.Errorf("third tangle: %v creating %v, want %v creating b.go and the manifest", got, out.created, want)
+	}
+	if data, _ := out.ReadFile("b.go"); string(data) != "package b\nvar x = 2\n" {
+		t.Errorf("b.go = %q", data)
+	}
+}
+
+func TestWriteFilesRemovesStale(t *testing.T) {
+	out := NewMemFS()
+	tangle := func(src string) (TangleSummary, string) {
+		t.Helper()
+		ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+		var log strings.Builder
+		ctx.Logger.SetOutput(&log)
+		ctx.Config["TangleLineRef"] = ""
+		ctx.Outputs = out
+		tg := NewTangler(ctx)
+		if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tg.WriteFiles(); err != nil {
+			t.Fatal(err)
+		}
+		return tg.Summary(), log.String()
+	}
+
+	tangle("<<* \"a.go\">>=\n    package a\n<<* \"c.go\">>=\n    package c\n")
+	if want := []string{MANIFEST_FILE, "a.go", "c.go"}; !slices.Equal(out.Names(), want) {
+		t.Fatalf("outputs = %v, want %v", out.Names(), want)
+	}
+
+	// c.go is edited by hand, so it is kept when it is no longer generated.
+	w, _ := out.Create("c.go")
+	io.WriteString(w, "package c // edited\n")
+	w.Close()
+	got, log := tangle("<<* \"b.go\">>=\n    package a\n")
+	if want := (TangleSummary{New: 1, Removed: 1}); got != want {
+		t.Errorf("renamed tangle: %v, want %v", got, want)
+	}
+	if want := []string{MANIFEST_FILE, "b.go", "c.go"}; !slices.Equal(out.Names(), want) {
+		t.Errorf("outputs = %v, want %v", out.Names(), want)
+	}
+	if !strings.Contains(log, "`c.go` is no longer generated but has been changed") {
+		t.Errorf("edited stale file not reported: %s", log)
+	}
+
+	// Clean keeps the edited c.go, and the manifest that lists it.
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	var cleanLog strings.Builder
+	ctx.Logger.SetOutput(&cleanLog)
+	ctx.Outputs = out
+	if err := Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{MANIFEST_FILE, "c.go"}; !slices.Equal(out.Names(), want) {
+		t.Errorf("after Clean, outputs = %v, want %v", out.Names(), want)
+	}
+	if !strings.Contains(cleanLog.String(), "`c.go` has been changed; not removing it") {
+		t.Errorf("edited file not reported by Clean: %s", cleanLog.String())
+	}
+	if entries, err := readManifest(ctx); err != nil || len(entries) != 1 || entries[0].File != "c.go" {
+		t.Errorf("after Clean, manifest = %v, %v", entries, err)
+	}
+
+	out.Remove("c.go")
+	if err := Clean(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names := out.Names(); len(names) != 0 {
+		t.Errorf("after second Clean, outputs = %v", names)
+	}
+}
+
+func TestWriteFilesFormatGo(t *testing.T) {
+	src := `<<* "a.go">>=
+    package a
+    func   f()   int {
+      return   1
+    }
+<<* "b.go">>=
+    package b
+
+    <<Broken function>>
+<<Broken function>>=
+    func g() {
+        return (1
+    }
+`
+	for _, lineRef := range []string{"", "/*line $filename:$lineno*/"} {
+		ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+		ctx.Logger.SetOutput(io.Discard)
+		ctx.Config["TangleLineRef"] = lineRef
+		ctx.FormatGo = true
+		out := NewMemFS()
+		ctx.Outputs = out
+		tg := NewTangler(ctx)
+		if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+			t.Fatal(err)
+		}
+		err := tg.WriteFiles()
+		if err == nil || !strings.HasPrefix(err.Error(), "prog.gw:12: ") ||
+			!strings.Contains(err.Error(), "in block `broken function`, b.go:") {
+			t.Errorf("with %q, WriteFiles() error = %v, want one at prog.gw:12", lineRef, err)
+		}
+		if data, _ := out.ReadFile("b.go"); !strings.Contains(string(data), "return (1") {
+			t.Errorf("with %q, b.go was not written as tangled: %q", lineRef, data)
+		}
+		if lineRef != "" {
+			continue
+		}
+		if data, _ := out.ReadFile("a.go"); string(data) != "package a\n\nfunc f() int {\n\treturn 1\n}\n" {
+			t.Errorf("a.go = %q", data)
+		}
+	}
+}
+
+func TestExecuteCommandMapsPositions(t *testing.T) {
+	src := `<<* "a.go">>=
+    package a
+    func   f()   int {
+        <<Return>>
+    }
+<<Return>>=
+    return   x
+`
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	var log strings.Builder
+	ctx.Logger.SetOutput(&log)
+	ctx.Config["TangleLineRef"] = ""
+	ctx.Config["Shell"] = "sh"
+	ctx.FormatGo = true
+	ctx.Outputs = NewMemFS()
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.WriteFiles(); err != nil {
+		t.Fatal(err)
+	}
+	log.Reset()
+
+	// gofmt moved the x of line 4 from column 18 to 9.
+	err := ctx.ExecuteCommand(`echo '# a'; echo './a.go:4:9: undefined: x' >&2; echo 'b.go:1:1: other'; exit 1`)
+	if err == nil {
+		t.Error("ExecuteCommand() of a failing command returned no error")
+	}
+	want := "# a\nprog.gw:7:14: undefined: x (in block `return`, ./a.go:4:9)\nb.go:1:1: other\n"
+	if log.String() != want {
+		t.Errorf("ExecuteCommand() printed %q, want %q", log.String(), want)
+	}
+
+	// the output of a command that succeeds is shown too, including a last
+	// line without a newline.
+	log.Reset()
+	if err := ctx.ExecuteCommand(`printf 'a.go:4\n'; printf 'a.go:4:9'`); err != nil {
+		t.Fatal(err)
+	}
+	want = "prog.gw:7 (in block `return`, a.go:4)\nprog.gw:7:14 (in block `return`, a.go:4:9)"
+	if log.String() != want {
+		t.Errorf("ExecuteCommand() printed %q, want %q", log.String(), want)
+	}
+}
+
+func TestExecuteCommandOutputInWeave(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	var log strings.Builder
+	ctx.Logger.SetOutput(&log)
+	ctx.Config["Shell"] = "sh"
+
+	// the output of a weave command is only shown if it fails.
+	if err := ctx.ExecuteCommand(`echo 'lots of output'`); err != nil {
+		t.Fatal(err)
+	}
+	if log.String() != "" {
+		t.Errorf("ExecuteCommand() of a command that succeeds printed %q", log.String())
+	}
+	if err := ctx.ExecuteCommand(`echo 'what went wrong'; exit 1`); err == nil {
+		t.Error("ExecuteCommand() of a failing command returned no error")
+	}
+	if want := "what went wrong\n"; log.String() != want {
+		t.Errorf("ExecuteCommand() printed %q, want %q", log.String(), want)
+	}
+
+	// when verbose, it is always shown.
+	log.Reset()
+	ctx.Verbose = 1
+	if err := ctx.ExecuteCommand(`echo 'lots of output'`); err != nil {
+		t.Fatal(err)
+	}
+	if want := "lots of output\n"; !strings.HasSuffix(log.String(), want) {
+		t.Errorf("ExecuteCommand() printed %q, want it to end with %q", log.String(), want)
+	}
+}
+
+func TestWriteFilesSourceMaps(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Logger.SetOutput(io.Discard)
+	ctx.Config["TangleLineRef"] = ""
+	ctx.SourceMaps = true
+	out := NewMemFS()
+	ctx.Outputs = out
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("prog.gw", strings.NewReader(tangleTestSource), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.WriteFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{MANIFEST_FILE, "out.go", "out.go" + SOURCE_MAP_EXT}; !slices.Equal(out.Names(), want) {
+		t.Fatalf("outputs = %v, want %v", out.Names(), want)
+	}
+
+	type pos struct {
+		File string
+		Line int
+	}
+	var sm struct {
+		Version int
+		File    string
+		Lines   []struct {
+			Segments []struct {
+				Start, Col int
+				Pos        pos
+				Block      string
+				Chain      []struct {
+					Block string
+					Pos   pos
+				}
+			}
+		}
+	}
+	data, _ := out.ReadFile("out.go" + SOURCE_MAP_EXT)
+	if err := json.Unmarshal(data, &sm); err != nil {
+		t.Fatalf("source map is not JSON: %v\n%s", err, data)
+	}
+	if sm.Version != SOURCE_MAP_VERSION || sm.File != "out.go" || len(sm.Lines) != 5 {
+		t.Fatalf("source map = %+v", sm)
+	}
+	if segs := sm.Lines[1].Segments; len(segs) != 1 || segs[0].Pos != (pos{"prog.gw", 5}) {
+		t.Errorf("blank line 2 segments = %+v", segs)
+	}
+	// "    return" is line 13, reached through the references in lines 6 and
+	// 10.
+	segs := sm.Lines[3].Segments
+	if len(segs) != 2 {
+		t.Fatalf("line 4 segments = %+v", segs)
+	}
+	s := segs[1]
+	if s.Start != 4 || s.Col != 4 || s.Pos != (pos{"prog.gw", 13}) || s.Block != "body of f" ||
+		len(s.Chain) != 2 || s.Chain[0].Block != "functions" || s.Chain[0].Pos != (pos{"prog.gw", 6}) ||
+		s.Chain[1].Block != "body of f" || s.Chain[1].Pos != (pos{"prog.gw", 10}) {
+		t.Errorf("line 4 segment 2 = %+v", s)
+	}
+}
+
+func TestTangleReferenceOnFirstLine(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	src := `<<* "main.go">>=
+    <<Helper function>>
+<<Helper function>>=
+    func double(x int) int {
+        return x * 2
+    }
+<<* "main.go">>=
+    <<Helper function>>
+`
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("main.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if err := tg.WriteFile("main.go", &out); err != nil {
+		t.Fatal(err)
+	}
+	// the line directives take up no room when the lines after the first
+	// are indented.
+	want := "/*line main.gw:2*//*line main.gw:4*/func double(x int) int {\n    return x * 2\n}\n" +
+		"/*line main.gw:8*//*line main.gw:4*/func double(x int) int {\n    return x * 2\n}\n"
+	if out.String() != want {
+		t.Errorf("WriteFile() = %q, want %q", out.String(), want)
+	}
+}
+
+func TestOriginInLineDirectives(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	ctx.Logger.SetOutput(io.Discard)
+	ctx.Outputs = NewMemFS()
+	src := `<<* "main.go">>=
+    package main
+    <<Helper>>
+<<Helper>>=
+    var x = 1
+<<Helper>>=
+    var y = 2
+`
+	tg := NewTangler(ctx)
+	if err := tg.Read(NewGlitterScannerFromReader("main.gw", strings.NewReader(src), ctx)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tg.WriteFiles(); err != nil {
+		t.Fatal(err)
+	}
+	lines := ctx.positions["main.go"]
+	if len(lines) != 3 || lines[2].Text != "/*line main.gw:7*/var y = 2" {
+		t.Fatalf("lines = %+v", lines)
+	}
+	for n, l := range lines {
+		for off := range len(l.Text) {
+			if s, ok := l.Origin(off); ok && s.SourceCol(off) < 0 {
+				t.Errorf("line %d: Origin(%d) has source column %d", n+1, off, s.SourceCol(off))
+			}
+		}
+	}
+	// the directive before "var x" belongs to it, not to the line with the
+	// reference.
+	l := lines[1]
+	off := strings.Index(l.Text, "/*line main.gw:5*/") + 3
+	if s, ok := l.Origin(off); !ok || s.Pos.LineNo() != 5 || s.SourceCol(off) != 4 {
+		t.Errorf("Origin(%d) of %q = %+v, column %d", off, l.Text, s, s.SourceCol(off))
+	}
+
+	got := string(ctx.mapPositions([]byte("main.go:3:1: a\nmain.go:3:19: b\n")))
+	want := "main.gw:7:5: a (in block `helper`, main.go:3:1)\nmain.gw:7:5: b (in block `helper`, main.go:3:19)\n"
+	if got != want {
+		t.Errorf("mapPositions() = %q, want %q", got, want)
+	}
+}
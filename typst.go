@@ -0,0 +1,211 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//=================================================================================
+// Typst backend
+//=================================================================================
+
+// typstTemplate defines the functions used by the Typst backend. It is the
+// Typst counterpart of glittertex.cls.
+//
+//go:embed glittertex.typ
+var typstTemplate string
+
+// typstBackend writes a Typst document. Text is written as it is, so it
+// should be Typst markup, and code chunks become calls to glitter-code
+// labeled with their block id and series. The template that defines
+// glitter-code and friends is copied into the start of the document.
+type typstBackend struct {
+	ctx *RunContext
+
+	inCode bool
+}
+
+// newTypstBackend creates a Typst backend for the given run.
+func newTypstBackend(ctx *RunContext) Backend {
+	return &typstBackend{ctx: ctx}
+}
+
+// typstString returns s as a Typst string literal.
+func typstString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// typstBlockId returns the id of the block as a Typst value: an integer, or
+// none if no visible chunk defines the block.
+func typstBlockId(info *WeaveBlockInfo) string {
+	if info == nil || len(info.Defs()) == 0 {
+		return "none"
+	}
+	return strconv.Itoa(info.Id())
+}
+
+// BeginDocument writes the template, the preamble, and starts the body.
+func (b *typstBackend) BeginDocument(w io.Writer, doc *WeaveDocument) error {
+	var sb strings.Builder
+	sb.WriteString(typstTemplate)
+	sb.WriteString("\n")
+	for _, l := range doc.Preamble {
+		sb.WriteString(l.line + "\n")
+	}
+	sb.WriteString("#show: glitter-book\n\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// EndDocument writes the list of key blocks.
+func (b *typstBackend) EndDocument(w io.Writer, doc *WeaveDocument) error {
+	_, err := io.WriteString(w, "#glitter-key-list()\n")
+	return err
+}
+
+// BeginText does nothing.
+func (b *typstBackend) BeginText(w io.Writer, chunk *TextChunk) error {
+	b.inCode = false
+	return nil
+}
+
+// EndText ends the paragraph.
+func (b *typstBackend) EndText(w io.Writer, chunk *TextChunk) error {
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// BeginCode starts a call to glitter-code. Its lines are given as an array of
+// content, one element per line.
+func (b *typstBackend) BeginCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = true
+	used := code.Block.UsedIn()
+	usedIn := make([]string, 0, len(used))
+	for _, id := range used {
+		usedIn = append(usedIn, strconv.Itoa(id))
+	}
+	array := strings.Join(usedIn, ", ")
+	if len(usedIn) == 1 {
+		// a Typst array with one element needs a trailing comma.
+		array += ","
+	}
+	_, err := fmt.Fprintf(w, "#glitter-code(%d, %d, %s, key: %v, prev: %v, next: %v, usedin: (%s), (\n",
+		code.Id, code.Series, typstString(code.Chunk.Name), code.Chunk.Key,
+		code.Series > 0, code.Series+1 < len(code.Block.Defs()), array)
+	return err
+}
+
+// EndCode ends the call to glitter-code and labels it with the block id and
+// series.
+func (b *typstBackend) EndCode(w io.Writer, code *WeaveCode) error {
+	b.inCode = false
+	_, err := fmt.Fprintf(w, "))<glitter-%d-%d>\n\n", code.Id, code.Series)
+	return err
+}
+
+// BeginLine starts the element that holds a line of code.
+func (b *typstBackend) BeginLine(w io.Writer, pos FilePos) error {
+	if !b.inCode {
+		return nil
+	}
+	_, err := io.WriteString(w, "  [")
+	return err
+}
+
+// EndLine ends the line.
+func (b *typstBackend) EndLine(w io.Writer) error {
+	s := "\n"
+	if b.inCode {
+		s = "],\n"
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// Text writes s as it is in text, and as raw Go code in code.
+func (b *typstBackend) Text(w io.Writer, s string) error {
+	if b.inCode {
+		s = fmt.Sprintf("#raw(%s, lang: \"go\");", typstString(s))
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+// CodeRef writes a call to glitter-code-ref.
+func (b *typstBackend) CodeRef(w io.Writer, ref *WeaveRef) error {
+	_, err := io.WriteString(w, typstRefs([]*WeaveRef{ref}))
+	return err
+}
+
+// InlineCode writes code as raw Go code.
+func (b *typstBackend) InlineCode(w io.Writer, code string) error {
+	_, err := io.WriteString(w, typstCode(code))
+	return err
+}
+
+// typstCode returns a call that writes code as raw Go code.
+func typstCode(code string) string {
+	return fmt.Sprintf("#raw(%s, lang: \"go\");", typstString(code))
+}
+
+// typstRefs returns calls to glitter-code-ref for refs, separated by commas.
+func typstRefs(refs []*WeaveRef) string {
+	calls := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		calls = append(calls, fmt.Sprintf("#glitter-code-ref(%s, %s);", typstBlockId(ref.Block), typstString(ref.Name)))
+	}
+	return strings.Join(calls, ", ")
+}
+
+// BlockAnnotations writes a paragraph with the names the chunk declares and
+// uses, with a reference to the block that declares each use.
+func (b *typstBackend) BlockAnnotations(w io.Writer, ann *WeaveAnnotations) error {
+	parts := make([]string, 0, 2)
+	if len(ann.Defines) > 0 {
+		names := make([]string, 0, len(ann.Defines))
+		for _, name := range ann.Defines {
+			names = append(names, typstCode(name))
+		}
+		parts = append(parts, b.ctx.GetConfig("IndexDefines")+" "+strings.Join(names, ", "))
+	}
+	if len(ann.Uses) > 0 {
+		names := make([]string, 0, len(ann.Uses))
+		for _, use := range ann.Uses {
+			name := typstCode(use.Name)
+			if use.Decl != nil {
+				name += " " + typstRefs([]*WeaveRef{use.Decl})
+			}
+			names = append(names, name)
+		}
+		parts = append(parts, b.ctx.GetConfig("IndexUses")+" "+strings.Join(names, ", "))
+	}
+	_, err := io.WriteString(w, strings.Join(parts, " ")+"\n\n")
+	return err
+}
+
+// BeginIndex writes IndexTitle, which is a heading by default.
+func (b *typstBackend) BeginIndex(w io.Writer) error {
+	_, err := io.WriteString(w, b.ctx.GetConfig("IndexTitle")+"\n\n")
+	return err
+}
+
+// IndexEntry writes a list item with the name and references to the blocks
+// that declare and use it.
+func (b *typstBackend) IndexEntry(w io.Writer, entry *WeaveIndexEntry) error {
+	s := "- " + typstCode(entry.Name) + ": " + typstRefs(entry.DefinedIn)
+	if len(entry.UsedIn) > 0 {
+		s += "; " + b.ctx.GetConfig("IndexUsedIn") + " " + typstRefs(entry.UsedIn)
+	}
+	_, err := io.WriteString(w, s+"\n")
+	return err
+}
+
+// EndIndex ends the list.
+func (b *typstBackend) EndIndex(w io.Writer) error {
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,45 @@
+package glitter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWeaveTypst(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	if err := ctx.SetFormat("typst"); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := ctx.GetConfig("WeaveCommand"); !strings.HasPrefix(cmd, "typst compile") {
+		t.Errorf("WeaveCommand = %q, want typst compile", cmd)
+	}
+	src := `##set text(size: 11pt)
+@:: See <<Block two>> and [[a "b"]].
+<<Block one>>=
+    <<Block two>>
+<<Block two>>=
+    x := 1
+`
+	var out strings.Builder
+	in := strings.NewReader(src)
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	typ := out.String()
+	for _, want := range []string{
+		"#let glitter-code(",
+		"#set text(size: 11pt)\n#show: glitter-book\n",
+		` See #glitter-code-ref(1, "Block two"); and #raw("a \"b\"", lang: "go");.`,
+		"#glitter-code(2, 0, \"Block one\", key: true, prev: false, next: false, usedin: (), (\n" +
+			"  [#glitter-code-ref(1, \"Block two\");],\n" +
+			"))<glitter-2-0>\n",
+		"#glitter-code(1, 0, \"Block two\", key: false, prev: false, next: false, usedin: (2,), (\n" +
+			"  [#raw(\"x := 1\", lang: \"go\");],\n" +
+			"))<glitter-1-0>\n",
+		"#glitter-key-list()\n",
+	} {
+		if !strings.Contains(typ, want) {
+			t.Errorf("output does not contain %q:\n%s", want, typ)
+		}
+	}
+}
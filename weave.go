@@ -0,0 +1,437 @@
+// (c) 2024 Carl Kingsford <carlk@cs.cmu.edu>.
+package glitter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+)
+
+//=================================================================================
+// Weaving - produce a file to typeset
+//=================================================================================
+
+// WeaveBlockInfo stores information about a code block while weaving.
+type WeaveBlockInfo struct {
+	name           string
+	firstBlockNum  int
+	firstMention   FilePos
+	defs           []*CodeChunk
+	hidden         []*CodeChunk
+	file           string
+	referencedFrom map[int]Void
+}
+
+// Id returns the number of the block. Blocks are numbered from 1 in the order
+// they are first mentioned, by a definition or a reference.
+func (b *WeaveBlockInfo) Id() int {
+	return b.firstBlockNum
+}
+
+// Name returns the name of the block as written in its first definition, or
+// in its first reference if it is not defined.
+func (b *WeaveBlockInfo) Name() string {
+	return b.name
+}
+
+// Defs returns the visible chunks that define the block, in order.
+func (b *WeaveBlockInfo) Defs() []*CodeChunk {
+	return b.defs
+}
+
+// Defined returns true if the block has a definition, even if every chunk
+// that defines it is hidden.
+func (b *WeaveBlockInfo) Defined() bool {
+	return len(b.defs) > 0 || len(b.hidden) > 0
+}
+
+// OutputFile returns the file a top-level block is written to, or "" for
+// other blocks.
+func (b *WeaveBlockInfo) OutputFile() string {
+	return b.file
+}
+
+// UsedIn returns the ids of the blocks that refer to this block, in
+// increasing order.
+func (b *WeaveBlockInfo) UsedIn() []int {
+	return slices.Sorted(maps.Keys(b.referencedFrom))
+}
+
+// Weaver produces a typesetable document from glitter sources.
+type Weaver struct {
+	ctx     *RunContext
+	backend Backend
+}
+
+// NewWeaver creates a Weaver for the given run, which must be a ModeWeave
+// run. The document is written in the format named by ctx.Format.
+func NewWeaver(ctx *RunContext) *Weaver {
+	return &Weaver{ctx: ctx}
+}
+
+// NewWeaverWithBackend creates a Weaver for the given run that writes the
+// document with b rather than with a built in format.
+func NewWeaverWithBackend(ctx *RunContext, b Backend) *Weaver {
+	return &Weaver{ctx: ctx, backend: b}
+}
+
+// Weave reads the given files and writes the typesetable document to out.
+func Weave(filenames []string, out io.Writer, ctx *RunContext) error {
+	return NewWeaver(ctx).Weave(NewGlitterScanner(filenames, ctx), out)
+}
+
+// writeStrings writes a set of strings.
+func writeStrings(w *bufio.Writer, a ...string) error {
+	for _, s := range a {
+		if _, err := w.WriteString(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeTextStart removes the text start code from the line.
+func removeTextStart(line string) string {
+	return textStartRegex.ReplaceAllString(line, "")
+}
+
+// replaceNoOpChars substitutes runs of the no op character with one fewer
+// character. So "#" is deleted, but "##" becomes "#" and "###" becomes "##".
+func replaceNoOpChars(line string) string {
+	return escapeRegex.ReplaceAllStringFunc(line, func(s string) string {
+		if len(s) == 0 {
+			return s
+		}
+		return s[1:]
+	})
+}
+
+// registerBlock returns the record for the block with the given canonical
+// name, creating it if the block has not been seen before.
+func (d *WeaveDocument) registerBlock(canonical, name string, pos FilePos) *WeaveBlockInfo {
+	if info, ok := d.blocks[canonical]; ok {
+		return info
+	}
+	info := &WeaveBlockInfo{
+		name:           name,
+		firstBlockNum:  len(d.byId) + 1,
+		firstMention:   pos,
+		defs:           make([]*CodeChunk, 0),
+		hidden:         make([]*CodeChunk, 0),
+		referencedFrom: make(map[int]Void),
+	}
+	d.blocks[canonical] = info
+	d.byId = append(d.byId, info)
+	return info
+}
+
+// indexBlocks numbers the blocks mentioned in the visible chunks and records
+// where each one is defined and used. This is done before anything is
+// written so that backends can link forward as well as back, and can say how
+// many chunks define a block. Hidden definitions are recorded too, but only
+// for blocks that the visible chunks mention, so that numbering the blocks
+// does not depend on what is hidden.
+func (d *WeaveDocument) indexBlocks() {
+	hidden := make([]*CodeChunk, 0)
+	for i, c := range d.Doc.Chunks {
+		d.order[c] = i
+		switch c := c.(type) {
+		case *TextChunk:
+			if c.Hidden {
+				continue
+			}
+			for _, l := range c.Lines {
+				if !l.Hidden {
+					d.indexRefs(l.line, l.pos, false, nil)
+				}
+			}
+		case *CodeChunk:
+			if c.Hidden {
+				hidden = append(hidden, c)
+				continue
+			}
+			info := d.registerBlock(c.Canonical, c.Name, c.pos)
+			// the block is named by its first definition, unless that
+			// abbreviates its name.
+			if _, abbrev := abbreviationPrefix(canonicalCodeName(info.name)); len(info.defs) == 0 || abbrev {
+				info.name = c.Name
+			}
+			info.defs = append(info.defs, c)
+			if c.TopLevel {
+				info.file = c.File
+			}
+			for _, l := range c.Lines {
+				if !l.Hidden {
+					d.indexRefs(l.line, l.pos, true, info)
+				}
+			}
+		}
+	}
+	for _, c := range hidden {
+		if info, ok := d.blocks[c.Canonical]; ok {
+			info.hidden = append(info.hidden, c)
+			if c.TopLevel {
+				info.file = c.File
+			}
+		}
+	}
+}
+
+// defsAround returns the series of the last visible chunk of the block that
+// comes before chunk number at of the document, and of the first that comes
+// after it, or -1 if there is none.
+func (d *WeaveDocument) defsAround(info *WeaveBlockInfo, at int) (prev, next int) {
+	prev, next = -1, -1
+	for i, c := range info.defs {
+		if n := d.order[c]; n < at {
+			prev = i
+		} else if n > at && next < 0 {
+			next = i
+		}
+	}
+	return prev, next
+}
+
+// indexRefs registers the blocks referred to in line. from is the block that
+// contains the line, or nil for text.
+func (d *WeaveDocument) indexRefs(line string, pos FilePos, inCode bool, from *WeaveBlockInfo) {
+	for _, m := range spanRegex(inCode).FindAllStringSubmatchIndex(line, -1) {
+		if m[2] < 0 {
+			continue
+		}
+		name := line[m[2]:m[3]]
+		info := d.registerBlock(d.Doc.Resolve(canonicalCodeName(name)), replaceNoOpChars(name), pos)
+		if from != nil {
+			info.referencedFrom[from.firstBlockNum] = Void{}
+		}
+	}
+}
+
+// spanRegex returns the regex that finds the parts of a line a backend
+// formats specially: code references, and also inline code in text.
+func spanRegex(inCode bool) *regexp.Regexp {
+	if inCode {
+		return codeRefRegex
+	}
+	return textSpanRegex
+}
+
+// Weave creates a typesetable stream from the lines read by scanner, writing
+// it to out.
+func (wv *Weaver) Weave(scanner *GlitterScanner, out io.Writer) error {
+	if wv.ctx.Mode != ModeWeave {
+		return fmt.Errorf("cannot weave in a %s run", wv.ctx.Mode)
+	}
+	doc, err := Parse(scanner)
+	if err != nil {
+		return err
+	}
+	return wv.WeaveDocument(doc, out)
+}
+
+// weaveRun holds the state of a single call to WeaveDocument.
+type weaveRun struct {
+	b   Backend
+	w   io.Writer
+	wd  *WeaveDocument
+	ctx *RunContext
+
+	// at is the number of the chunk being woven.
+	at int
+}
+
+// indexing returns true if the Go names that each chunk declares and uses are
+// sent after it, and the index of all the names is sent at the end of the
+// document.
+func (r *weaveRun) indexing() bool {
+	return r.ctx.GetConfig("WeaveIndex") == "true"
+}
+
+// backendOrDefault returns the backend the weaver writes with.
+func (wv *Weaver) backendOrDefault() (Backend, error) {
+	if wv.backend != nil {
+		return wv.backend, nil
+	}
+	format, err := LookupFormat(wv.ctx.Format)
+	if err != nil {
+		return nil, err
+	}
+	return format.NewBackend(wv.ctx), nil
+}
+
+// newWeaveDocument numbers the blocks of doc, collects its visible preamble,
+// and indexes its Go code.
+func newWeaveDocument(ctx *RunContext, doc *Document) *WeaveDocument {
+	wd := &WeaveDocument{
+		Doc:      doc,
+		Preamble: make([]SourceLine, 0),
+		GoIndex:  NewGoIndex(ctx, doc),
+		blocks:   make(map[string]*WeaveBlockInfo),
+		byId:     make([]*WeaveBlockInfo, 0),
+		order:    make(map[Chunk]int),
+	}
+	wd.indexBlocks()
+
+	// lines before the first block are sent out with minimal processing.
+	for _, l := range doc.Preamble {
+		if !l.Hidden {
+			l.line = replaceNoOpChars(l.line)
+			wd.Preamble = append(wd.Preamble, l.SourceLine)
+		}
+	}
+	return wd
+}
+
+// WeaveDocument writes a typesetable stream for the parsed document to out.
+func (wv *Weaver) WeaveDocument(doc *Document, out io.Writer) error {
+	b, err := wv.backendOrDefault()
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	wd := newWeaveDocument(wv.ctx, doc)
+	r := &weaveRun{b: b, w: w, wd: wd, ctx: wv.ctx}
+	err = r.weaveChunks(doc.Chunks, true)
+	if err == nil {
+		wv.printUndefinedBlocks(wd)
+	}
+	return err
+}
+
+// weaveChunks sends the visible chunks among chunks to the backend, between
+// the start and end of the document, followed by the index of Go names if
+// index is true.
+func (r *weaveRun) weaveChunks(chunks []Chunk, index bool) error {
+	err := r.b.BeginDocument(r.w, r.wd)
+	for _, c := range chunks {
+		if err != nil {
+			return err
+		}
+		r.at = r.wd.order[c]
+		switch c := c.(type) {
+		case *TextChunk:
+			if !c.Hidden {
+				err = r.weaveText(c)
+			}
+		case *CodeChunk:
+			if !c.Hidden {
+				err = r.weaveCode(c)
+			}
+		}
+	}
+	if err == nil && index && r.indexing() {
+		err = r.weaveIndex()
+	}
+	if err == nil {
+		err = r.b.EndDocument(r.w, r.wd)
+	}
+	return err
+}
+
+// weaveText sends a visible text chunk to the backend.
+func (r *weaveRun) weaveText(c *TextChunk) error {
+	err := r.b.BeginText(r.w, c)
+	for _, l := range c.Lines {
+		if err == nil && !l.Hidden {
+			err = r.weaveLine(l.pos, l.line, false)
+		}
+	}
+	if err == nil {
+		err = r.b.EndText(r.w, c)
+	}
+	return err
+}
+
+// weaveCode sends a visible code chunk to the backend. The visible lines are
+// deindented and the blank lines around them are removed.
+func (r *weaveRun) weaveCode(c *CodeChunk) error {
+	info := r.wd.blocks[c.Canonical]
+	code := &WeaveCode{
+		Chunk:  c,
+		Block:  info,
+		Id:     info.firstBlockNum,
+		Series: slices.Index(info.defs, c),
+	}
+
+	block := Block{}
+	for _, l := range c.Lines {
+		if !l.Hidden {
+			block.AppendLine(l.SourceLine)
+		}
+	}
+	block = removeBlankLines(deindentBlock(block))
+
+	err := r.b.BeginCode(r.w, code)
+	for _, l := range block.lines {
+		if err == nil {
+			err = r.weaveLine(l.pos, l.line, true)
+		}
+	}
+	if err == nil {
+		err = r.b.EndCode(r.w, code)
+	}
+	if err == nil && r.indexing() {
+		err = r.weaveAnnotations(code)
+	}
+	return err
+}
+
+// weaveLine splits a line into plain text, code references and (outside of
+// code) inline code, and sends the pieces to the backend.
+func (r *weaveRun) weaveLine(pos FilePos, line string, inCode bool) error {
+	err := r.b.BeginLine(r.w, pos)
+	cp := 0
+	for _, m := range spanRegex(inCode).FindAllStringSubmatchIndex(line, -1) {
+		if err == nil && m[0] > cp {
+			err = r.b.Text(r.w, replaceNoOpChars(line[cp:m[0]]))
+		}
+		if err != nil {
+			return err
+		}
+		cp = m[1]
+		if m[2] < 0 {
+			err = r.b.InlineCode(r.w, replaceNoOpChars(line[m[4]:m[5]]))
+			continue
+		}
+		name := line[m[2]:m[3]]
+		canonical := r.wd.Doc.Resolve(canonicalCodeName(name))
+		err = r.b.CodeRef(r.w, r.newRef(replaceNoOpChars(name), canonical, r.wd.blocks[canonical], inCode))
+	}
+	if err == nil && cp < len(line) {
+		err = r.b.Text(r.w, replaceNoOpChars(line[cp:]))
+	}
+	if err == nil {
+		err = r.b.EndLine(r.w)
+	}
+	return err
+}
+
+// newRef describes a reference, made from the chunk being woven, to the block
+// info.
+func (r *weaveRun) newRef(name, canonical string, info *WeaveBlockInfo, inCode bool) *WeaveRef {
+	prev, next := r.wd.defsAround(info, r.at)
+	return &WeaveRef{
+		Name:      name,
+		Canonical: canonical,
+		Block:     info,
+		Id:        info.firstBlockNum,
+		InCode:    inCode,
+		Prev:      prev,
+		Next:      next,
+	}
+}
+
+// printUndefinedBlocks prints the undefined blocks.
+func (wv *Weaver) printUndefinedBlocks(wd *WeaveDocument) {
+	for _, b := range wd.byId {
+		if !b.Defined() {
+			wv.ctx.InfoWithFile(0, &b.firstMention, "Error: undefined block (#%d): `%s`",
+				b.firstBlockNum, canonicalCodeName(b.name))
+		}
+	}
+}
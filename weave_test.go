@@ -0,0 +1,221 @@
+package glitter
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const weaveTestSource = `@: Some text with [[x]].
+<<Block one>>=
+    x := 1
+    <<Block two>>
+<<Block two>>=
+    y := 2
+`
+
+func TestWeaveConcurrentContexts(t *testing.T) {
+	var wg sync.WaitGroup
+	outs := make([]string, 8)
+	errs := make([]error, 8)
+	for i := range outs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+			ctx.Config["StartText"] = fmt.Sprintf("<text %d>", i)
+			var out strings.Builder
+			in := strings.NewReader(weaveTestSource)
+			errs[i] = NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), &out)
+			outs[i] = out.String()
+		}(i)
+	}
+	wg.Wait()
+	for i, out := range outs {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		want := fmt.Sprintf("<text %d>", i)
+		if !strings.Contains(out, want) || strings.Count(out, "<text ") != 1 {
+			t.Errorf("weave %d: output does not use its own config:\n%s", i, out)
+		}
+		if !strings.Contains(out, `%%line 1 "w.gw"`) {
+			t.Errorf("weave %d: missing weave line ref:\n%s", i, out)
+		}
+	}
+}
+
+func TestWeaveRejectsTangleContext(t *testing.T) {
+	ctx := NewRunContext(ModeTangle, NewGlitterOptions())
+	err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", strings.NewReader(""), ctx), &strings.Builder{})
+	if err == nil {
+		t.Error("expected an error weaving with a tangle context")
+	}
+}
+
+// eventBackend records the events it receives.
+type eventBackend struct {
+	events []string
+}
+
+func (b *eventBackend) add(w io.Writer, format string, args ...any) error {
+	b.events = append(b.events, fmt.Sprintf(format, args...))
+	return nil
+}
+
+func (b *eventBackend) BeginDocument(w io.Writer, doc *WeaveDocument) error {
+	return b.add(w, "begin document %d", len(doc.Preamble))
+}
+func (b *eventBackend) EndDocument(w io.Writer, doc *WeaveDocument) error {
+	return b.add(w, "end document")
+}
+func (b *eventBackend) BeginText(w io.Writer, chunk *TextChunk) error { return b.add(w, "text") }
+func (b *eventBackend) EndText(w io.Writer, chunk *TextChunk) error   { return b.add(w, "end text") }
+func (b *eventBackend) BeginCode(w io.Writer, code *WeaveCode) error {
+	return b.add(w, "code %s #%d.%d", code.Chunk.Name, code.Id, code.Series)
+}
+func (b *eventBackend) EndCode(w io.Writer, code *WeaveCode) error { return b.add(w, "end code") }
+func (b *eventBackend) BeginLine(w io.Writer, pos FilePos) error {
+	return b.add(w, "line %d", pos.LineNo())
+}
+func (b *eventBackend) EndLine(w io.Writer) error        { return nil }
+func (b *eventBackend) Text(w io.Writer, s string) error { return b.add(w, "%q", s) }
+func (b *eventBackend) CodeRef(w io.Writer, ref *WeaveRef) error {
+	return b.add(w, "ref %s #%d code=%v", ref.Name, ref.Id, ref.InCode)
+}
+func (b *eventBackend) InlineCode(w io.Writer, code string) error { return b.add(w, "inline %s", code) }
+func (b *eventBackend) BlockAnnotations(w io.Writer, ann *WeaveAnnotations) error {
+	uses := make([]string, 0, len(ann.Uses))
+	for _, use := range ann.Uses {
+		if use.Decl == nil {
+			uses = append(uses, use.Name)
+		} else {
+			uses = append(uses, fmt.Sprintf("%s #%d", use.Name, use.Decl.Id))
+		}
+	}
+	return b.add(w, "annotations #%d defines=%v uses=%v", ann.Code.Id, ann.Defines, uses)
+}
+func (b *eventBackend) BeginIndex(w io.Writer) error { return b.add(w, "index") }
+func (b *eventBackend) IndexEntry(w io.Writer, entry *WeaveIndexEntry) error {
+	ids := func(refs []*WeaveRef) []int {
+		out := make([]int, 0, len(refs))
+		for _, ref := range refs {
+			out = append(out, ref.Id)
+		}
+		return out
+	}
+	return b.add(w, "entry %s defined=%v used=%v", entry.Name, ids(entry.DefinedIn), ids(entry.UsedIn))
+}
+func (b *eventBackend) EndIndex(w io.Writer) error { return b.add(w, "end index") }
+
+func TestWeaveBackendEvents(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	b := &eventBackend{}
+	in := strings.NewReader("pre\n" + weaveTestSource + "@: [[a##b]] <<Block #one>>\n")
+	err := NewWeaverWithBackend(ctx, b).Weave(NewGlitterScannerFromReader("w.gw", in, ctx), io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"begin document 1",
+		"text", "line 2", `" Some text with "`, "inline x", `"."`, "end text",
+		"code Block one #1.0",
+		"line 4", `"x := 1"`,
+		"line 5", "ref Block two #2 code=true",
+		"end code",
+		"code Block two #2.0", "line 7", `"y := 2"`, "end code",
+		"text", "line 8", `" "`, "inline a#b", `" "`, "ref Block one #1 code=false", "end text",
+		"end document",
+	}
+	if !slices.Equal(b.events, want) {
+		t.Errorf("events =\n%s\nwant\n%s", strings.Join(b.events, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestWeaveUnknownFormat(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	ctx.Format = "troff"
+	err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", strings.NewReader(""), ctx), io.Discard)
+	if err == nil {
+		t.Error("expected an error weaving in an unknown format")
+	}
+}
+
+func TestWeaveCrossReferenceVars(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	var log strings.Builder
+	ctx.Logger.SetOutput(&log)
+	ctx.Config["WeaveIndex"] = "false"
+	ctx.Config["CodeSet"] = "[set $blockid/$blockseries n=$ndefs prev=$prevdef next=$nextdef used=$usedin out=$outputfile]"
+	ctx.Config["CodeRef"] = "[ref $name $blockid n=$ndefs prev=$prevdef next=$nextdef used=$usedin]"
+	src := `@: Uses <<Setup>>.
+<<* "prog.go">>=
+    <<Setup>>
+    <<Body>>
+<<Body>>=
+    a()
+@: More.
+<<Body>>=
+    b()
+@glitter hide
+<<Setup>>=
+    s()
+@glitter show
+`
+	var out strings.Builder
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", strings.NewReader(src), ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"Uses [ref Setup  n=0 prev= next= used=2].",
+		"[set 2/0 n=1 prev= next= used= out=prog.go]",
+		"@[ref Setup  n=0 prev= next= used=2]@",
+		"@[ref Body 3 n=2 prev= next=0 used=2]@",
+		"[set 3/0 n=2 prev= next=1 used=2 out=]",
+		"[set 3/1 n=2 prev=0 next= used=2 out=]",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "s()") {
+		t.Errorf("hidden block was woven:\n%s", out.String())
+	}
+	if strings.Contains(log.String(), "undefined") {
+		t.Errorf("hidden block reported as undefined: %s", log.String())
+	}
+}
+
+func TestReadConfigNewlines(t *testing.T) {
+	o := NewGlitterOptions()
+	in := strings.NewReader("%%glitter CodeSet a$n$n next=$nextdef$n_x $n\n")
+	if err := o.ReadConfigFrom(in); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := o.GetConfig("CodeSet"), "a\n\n next=$nextdef$n_x \n"; got != want {
+		t.Errorf("CodeSet = %q, want %q", got, want)
+	}
+}
+
+func TestWeaveGlittertexCodeSet(t *testing.T) {
+	ctx := NewRunContext(ModeWeave, NewGlitterOptions())
+	if err := ctx.ReadConfig("cmd/glitter/glittertex.cls"); err != nil {
+		t.Fatal(err)
+	}
+	src := `<<Body>>=
+    a()
+<<Body>>=
+    b()
+`
+	var out strings.Builder
+	if err := NewWeaver(ctx).Weave(NewGlitterScannerFromReader("w.gw", strings.NewReader(src), ctx), &out); err != nil {
+		t.Fatal(err)
+	}
+	want := `\glitterSet{blocktable=false,blockid=1,blockseries=0,prevdef=,nextdef=1,usedin={}}`
+	if !strings.Contains(out.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, out.String())
+	}
+}